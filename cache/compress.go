@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rolandshoemaker/ctat/common"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// roughly how many uncompressed bytes of entries go in each gzip member
+var compressedMemberSize = int64(16 * 1024 * 1024)
+
+// copySTHs copies the stored STHs for a cache file to a copy of it so the copy
+// can still be verified and updated
+func copySTHs(cacheFilename, outFilename string) error {
+	sths, err := common.LoadSTHs(cacheFilename)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(common.STHFilename(outFilename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, sth := range sths {
+		if err = common.AppendSTH(outFilename, sth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compress writes a compressed copy of an uncompressed cache file
+func Compress(cacheFilename, outFilename string) error {
+	if err := common.RequireUncompressed(cacheFilename); err != nil {
+		return err
+	}
+	entries, err := common.LoadCacheFile(cacheFilename)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+	out, err := os.OpenFile(outFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// members end on entry boundaries like the ones written by download
+	memberStart, memberEnd := int64(0), int64(0)
+	var writeErr error
+	writeMember := func() {
+		data := make([]byte, memberEnd-memberStart)
+		if _, writeErr = entries.File.ReadAt(data, memberStart); writeErr != nil {
+			return
+		}
+		if data, writeErr = common.CompressEntries(data); writeErr != nil {
+			return
+		}
+		_, writeErr = out.Write(data)
+		memberStart = memberEnd
+	}
+	err = common.OrderedMap(entries, func(ent *ct.EntryAndPosition, err error) {
+		if writeErr != nil {
+			return
+		}
+		if ent == nil {
+			writeErr = fmt.Errorf("failed to read entry: %s", err)
+			return
+		}
+		memberEnd = ent.Offset + int64(ent.Length)
+		if memberEnd-memberStart >= compressedMemberSize {
+			writeMember()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr == nil && memberEnd > memberStart {
+		writeMember()
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return copySTHs(cacheFilename, outFilename)
+}
+
+// Decompress writes an uncompressed copy of a compressed cache file
+func Decompress(cacheFilename, outFilename string) error {
+	if compressed, err := common.IsCompressed(cacheFilename); err != nil {
+		return err
+	} else if !compressed {
+		return fmt.Errorf("%s isn't compressed", cacheFilename)
+	}
+	file, err := os.Open(cacheFilename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(outFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, gz); err != nil {
+		return err
+	}
+	return copySTHs(cacheFilename, outFilename)
+}
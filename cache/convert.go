@@ -0,0 +1,323 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rolandshoemaker/ctat/common"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// jsonEntry is a single line of the JSONL format, only leaf_input and
+// extra_data are needed to read a line back, the rest are there for tools
+// that don't want to parse the leaf
+type jsonEntry struct {
+	Index       uint64   `json:"index"`
+	LeafInput   []byte   `json:"leaf_input"`
+	ExtraData   []byte   `json:"extra_data"`
+	Timestamp   uint64   `json:"timestamp"`
+	EntryType   string   `json:"entry_type"`
+	Certificate []byte   `json:"certificate"`
+	Chain       [][]byte `json:"chain"`
+}
+
+const (
+	pemCertificate    = "CERTIFICATE"
+	pemPrecertificate = "PRECERTIFICATE TBS"
+)
+
+type entryReader func(func(index uint64, leafInput []byte, entry *ct.Entry) error) error
+
+type entryWriter interface {
+	write(index uint64, leafInput []byte, entry *ct.Entry) error
+	close() error
+}
+
+func readCache(filename string) entryReader {
+	return func(fn func(uint64, []byte, *ct.Entry) error) error {
+		entries, err := common.LoadCacheFile(filename)
+		if err != nil {
+			return err
+		}
+		defer entries.Close()
+		var fnErr error
+		err = common.OrderedMap(entries, func(ent *ct.EntryAndPosition, err error) {
+			if fnErr != nil {
+				return
+			}
+			if err != nil {
+				fnErr = fmt.Errorf("failed to read entry: %s", err)
+				return
+			}
+			fnErr = fn(ent.Index, ent.Raw, ent.Entry)
+		})
+		if err != nil {
+			return err
+		}
+		return fnErr
+	}
+}
+
+func readJSONL(filename string) entryReader {
+	return func(fn func(uint64, []byte, *ct.Entry) error) error {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		s.Buffer(nil, 64*1024*1024)
+		line := 0
+		for s.Scan() {
+			line++
+			if len(s.Bytes()) == 0 {
+				continue
+			}
+			var je jsonEntry
+			if err = json.Unmarshal(s.Bytes(), &je); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			entry, err := ct.ParseEntry(je.LeafInput, je.ExtraData)
+			if err != nil {
+				return fmt.Errorf("line %d: failed to parse entry: %s", line, err)
+			}
+			if err = fn(je.Index, je.LeafInput, entry); err != nil {
+				return err
+			}
+		}
+		return s.Err()
+	}
+}
+
+type pemFile struct {
+	index uint64
+	name  string
+}
+
+type pemFiles []pemFile
+
+func (p pemFiles) Len() int           { return len(p) }
+func (p pemFiles) Less(i, j int) bool { return p[i].index < p[j].index }
+func (p pemFiles) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func readPEMDir(dir string) entryReader {
+	return func(fn func(uint64, []byte, *ct.Entry) error) error {
+		files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+		indexed := pemFiles{}
+		for _, name := range files {
+			index, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".pem"), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s isn't named after an entry index", name)
+			}
+			indexed = append(indexed, pemFile{index, name})
+		}
+		sort.Sort(indexed)
+		for _, pf := range indexed {
+			contents, err := ioutil.ReadFile(pf.name)
+			if err != nil {
+				return err
+			}
+			entry, err := parsePEMEntry(contents)
+			if err != nil {
+				return fmt.Errorf("%s: %s", pf.name, err)
+			}
+			if err = fn(pf.index, common.MarshalLeaf(entry), entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func parsePEMEntry(contents []byte) (*ct.Entry, error) {
+	leaf, rest := pem.Decode(contents)
+	if leaf == nil {
+		return nil, fmt.Errorf("no PEM blocks found")
+	}
+	entry := &ct.Entry{}
+	timestamp, err := strconv.ParseUint(leaf.Headers["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Timestamp header: %s", err)
+	}
+	entry.Timestamp = timestamp
+	switch leaf.Type {
+	case pemCertificate:
+		entry.Type = ct.X509Entry
+		entry.X509Cert = leaf.Bytes
+	case pemPrecertificate:
+		entry.Type = ct.PreCertEntry
+		entry.TBSCert = leaf.Bytes
+		keyHash, err := hex.DecodeString(leaf.Headers["Issuer-Key-Hash"])
+		if err != nil || len(keyHash) != len(entry.PreCertIssuerKeyHash) {
+			return nil, fmt.Errorf("invalid Issuer-Key-Hash header")
+		}
+		copy(entry.PreCertIssuerKeyHash[:], keyHash)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type %q", leaf.Type)
+	}
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != pemCertificate {
+			return nil, fmt.Errorf("unexpected PEM block type %q in chain", block.Type)
+		}
+		entry.ExtraCerts = append(entry.ExtraCerts, block.Bytes)
+	}
+	return entry, nil
+}
+
+type cacheWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (cw *cacheWriter) write(_ uint64, leafInput []byte, entry *ct.Entry) error {
+	return common.WriteEntry(cw.w, leafInput, common.ExtraData(entry))
+}
+
+func (cw *cacheWriter) close() error {
+	if err := cw.w.Flush(); err != nil {
+		cw.f.Close()
+		return err
+	}
+	return cw.f.Close()
+}
+
+type jsonlWriter struct {
+	f *os.File
+	w *bufio.Writer
+	e *json.Encoder
+}
+
+func (jw *jsonlWriter) write(index uint64, leafInput []byte, entry *ct.Entry) error {
+	je := jsonEntry{
+		Index:     index,
+		LeafInput: leafInput,
+		ExtraData: common.ExtraData(entry),
+		Timestamp: entry.Timestamp,
+		Chain:     entry.ExtraCerts,
+	}
+	switch entry.Type {
+	case ct.X509Entry:
+		je.EntryType = "x509_entry"
+		je.Certificate = entry.X509Cert
+	case ct.PreCertEntry:
+		je.EntryType = "precert_entry"
+		je.Certificate = entry.TBSCert
+	}
+	return jw.e.Encode(je)
+}
+
+func (jw *jsonlWriter) close() error {
+	if err := jw.w.Flush(); err != nil {
+		jw.f.Close()
+		return err
+	}
+	return jw.f.Close()
+}
+
+type pemWriter struct {
+	dir string
+}
+
+func (pw *pemWriter) write(index uint64, _ []byte, entry *ct.Entry) error {
+	leaf := &pem.Block{Headers: map[string]string{
+		"Index":     fmt.Sprintf("%d", index),
+		"Timestamp": fmt.Sprintf("%d", entry.Timestamp),
+	}}
+	switch entry.Type {
+	case ct.X509Entry:
+		leaf.Type = pemCertificate
+		leaf.Bytes = entry.X509Cert
+	case ct.PreCertEntry:
+		leaf.Type = pemPrecertificate
+		leaf.Bytes = entry.TBSCert
+		leaf.Headers["Issuer-Key-Hash"] = hex.EncodeToString(entry.PreCertIssuerKeyHash[:])
+	default:
+		return fmt.Errorf("entry %d has unknown entry type %d", index, entry.Type)
+	}
+	contents := pem.EncodeToMemory(leaf)
+	for _, c := range entry.ExtraCerts {
+		contents = append(contents, pem.EncodeToMemory(&pem.Block{Type: pemCertificate, Bytes: c})...)
+	}
+	return ioutil.WriteFile(filepath.Join(pw.dir, fmt.Sprintf("%d.pem", index)), contents, 0666)
+}
+
+func (pw *pemWriter) close() error {
+	return nil
+}
+
+// Convert rewrites the entries in a cache file, a JSONL file, or a directory
+// of PEM files, as one of the other formats
+func Convert(in, out, from, to string) error {
+	var read entryReader
+	switch from {
+	case "cache":
+		read = readCache(in)
+	case "jsonl":
+		read = readJSONL(in)
+	case "pem":
+		read = readPEMDir(in)
+	default:
+		return fmt.Errorf("unknown input format %q, must be one of cache, jsonl, or pem", from)
+	}
+
+	var w entryWriter
+	switch to {
+	case "cache", "jsonl":
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		if to == "cache" {
+			w = &cacheWriter{f, bw}
+		} else {
+			w = &jsonlWriter{f, bw, json.NewEncoder(bw)}
+		}
+	case "pem":
+		if err := os.MkdirAll(out, 0777); err != nil {
+			return err
+		}
+		w = &pemWriter{out}
+	default:
+		return fmt.Errorf("unknown output format %q, must be one of cache, jsonl, or pem", to)
+	}
+
+	count := 0
+	next := uint64(0)
+	err := read(func(index uint64, leafInput []byte, entry *ct.Entry) error {
+		if to == "cache" && index != next {
+			return fmt.Errorf("input is missing entry %d, a cache file can't have gaps", next)
+		}
+		next = index + 1
+		count++
+		return w.write(index, leafInput, entry)
+	})
+	if err == nil {
+		err = w.close()
+	} else {
+		w.close()
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("converted %d entries\n", count)
+	return nil
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rolandshoemaker/ctat/common"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// Slice copies the entries [from, to) from a cache file into a new one
+func Slice(cacheFile, outFile string, from, to uint64) error {
+	if from >= to {
+		return fmt.Errorf("--from must be less than --to")
+	}
+	if err := common.RequireUncompressed(cacheFile); err != nil {
+		return err
+	}
+	entries, err := common.LoadCacheFile(cacheFile)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+
+	var offset, length int64
+	idx, err := common.OpenCurrentIndex(cacheFile)
+	if err != nil {
+		return err
+	}
+	if idx != nil {
+		defer idx.Close()
+		if to > idx.Count() {
+			return fmt.Errorf("cache file only contains %d entries", idx.Count())
+		}
+		offset, length, err = idx.Range(from, to)
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("finding entries in cache file (use 'cache index' to skip this next time)...")
+		found := 0
+		err = common.OrderedMap(entries, func(ent *ct.EntryAndPosition, err error) {
+			if ent == nil {
+				return
+			}
+			if ent.Index == from {
+				offset = ent.Offset
+				found++
+			}
+			if ent.Index == to-1 {
+				length = ent.Offset + int64(ent.Length) - offset
+				found++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if found != 2 {
+			return fmt.Errorf("cache file doesn't contain entries %d-%d", from, to-1)
+		}
+	}
+
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, io.NewSectionReader(entries.File, offset, length)); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d entries to %s\n", to-from, outFile)
+	return nil
+}
+
+// Merge concatenates cache files into a new one, skipping entries with a leaf
+// hash that has already been seen
+func Merge(outFile string, cacheFiles []string) error {
+	out, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	seen := make(map[[32]byte]struct{})
+	total := 0
+	for _, cacheFile := range cacheFiles {
+		if err := common.RequireUncompressed(cacheFile); err != nil {
+			return err
+		}
+		entries, err := common.LoadCacheFile(cacheFile)
+		if err != nil {
+			return err
+		}
+		added, dups := 0, 0
+		var mergeErr error
+		err = common.OrderedMap(entries, func(ent *ct.EntryAndPosition, err error) {
+			if mergeErr != nil {
+				return
+			}
+			if ent == nil {
+				mergeErr = fmt.Errorf("failed to read entry: %s", err)
+				return
+			}
+			leafHash := common.LeafHash(ent.Raw)
+			if _, present := seen[leafHash]; present {
+				dups++
+				return
+			}
+			seen[leafHash] = struct{}{}
+			// copy the entry as is rather than re-encoding it
+			record := make([]byte, ent.Length)
+			if _, mergeErr = entries.File.ReadAt(record, ent.Offset); mergeErr != nil {
+				return
+			}
+			if _, mergeErr = w.Write(record); mergeErr != nil {
+				return
+			}
+			added++
+		})
+		entries.Close()
+		if err == nil {
+			err = mergeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %s", cacheFile, err)
+		}
+		fmt.Printf("%s: %d entries added, %d duplicates skipped\n", cacheFile, added, dups)
+		total += added
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d entries to %s\n", total, outFile)
+	return nil
+}
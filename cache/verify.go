@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/rolandshoemaker/ctat/common"
+	"github.com/rolandshoemaker/ctat/downloader"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+type verifier struct {
+	targets map[uint64]*common.SignedTreeHead
+
+	// tree state at each STH size
+	states map[uint64]*common.TreeHasher
+
+	firstBadIdx uint64
+	badEntries  int
+
+	// leaf hashes are spilled to disk so the diverging range can be
+	// narrowed down without parsing the cache again
+	hashes *os.File
+	hErr   error
+}
+
+func (v *verifier) hashEntries(entries *common.CacheFile) (uint64, error) {
+	th := new(common.TreeHasher)
+	v.states[0] = th.Copy()
+	err := common.OrderedMap(entries, func(ent *ct.EntryAndPosition, err error) {
+		if err != nil || ent == nil {
+			if v.badEntries == 0 && ent != nil {
+				v.firstBadIdx = ent.Index
+			}
+			v.badEntries++
+			if ent == nil {
+				return
+			}
+		}
+		leafHash := common.LeafHash(ent.Raw)
+		th.Add(leafHash)
+		if _, present := v.targets[th.Size()]; present {
+			v.states[th.Size()] = th.Copy()
+		}
+		if v.hashes != nil && v.hErr == nil {
+			_, v.hErr = v.hashes.Write(leafHash[:])
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if v.hErr != nil {
+		return 0, fmt.Errorf("failed to write leaf hashes: %s", v.hErr)
+	}
+	return th.Size(), nil
+}
+
+// advance rebuilds the tree state for the given size from the spilled leaf
+// hashes, starting from a known earlier state
+func (v *verifier) advance(from *common.TreeHasher, size uint64) (*common.TreeHasher, error) {
+	th := from.Copy()
+	if _, err := v.hashes.Seek(int64(th.Size())*32, 0); err != nil {
+		return nil, err
+	}
+	var leafHash [32]byte
+	for th.Size() < size {
+		if _, err := io.ReadFull(v.hashes, leafHash[:]); err != nil {
+			return nil, err
+		}
+		th.Add(leafHash)
+	}
+	return th, nil
+}
+
+// consistentPrefix checks if the first size local entries are a prefix of the
+// tree described by sth
+func (v *verifier) consistentPrefix(logURI string, from *common.TreeHasher, size uint64, sth *common.SignedTreeHead) (bool, error) {
+	th, err := v.advance(from, size)
+	if err != nil {
+		return false, err
+	}
+	localRoot := th.Root()
+	proof, err := downloader.GetConsistencyProof(logURI, size, sth.TreeSize)
+	if err != nil {
+		return false, err
+	}
+	sthRoot, err := sth.Root()
+	if err != nil {
+		return false, err
+	}
+	return common.VerifyConsistency(size, sth.TreeSize, localRoot, sthRoot, proof) == nil, nil
+}
+
+// narrow binary searches (good, bad] for the first entry that causes the local
+// tree to diverge from sth, it returns the index of that entry
+func (v *verifier) narrow(logURI string, good, bad uint64, sth *common.SignedTreeHead) (uint64, error) {
+	from := v.states[good]
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		fmt.Printf("checking prefix of %d entries against the log...\n", mid)
+		ok, err := v.consistentPrefix(logURI, from, mid, sth)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			// so the next probe doesn't start from the beginning again
+			if from, err = v.advance(from, mid); err != nil {
+				return 0, err
+			}
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return good, nil
+}
+
+func Verify(cacheFile, logURI string) error {
+	sths, err := common.LoadSTHs(cacheFile)
+	if err != nil {
+		return fmt.Errorf("failed to load stored STHs: %s", err)
+	}
+	if len(sths) == 0 {
+		return fmt.Errorf("no STHs stored for %s, update it with download first", cacheFile)
+	}
+	sort.Sort(sthsBySize(sths))
+	v := verifier{
+		targets: make(map[uint64]*common.SignedTreeHead),
+		states:  make(map[uint64]*common.TreeHasher),
+	}
+	for _, sth := range sths {
+		v.targets[sth.TreeSize] = sth
+	}
+	if logURI != "" {
+		v.hashes, err = ioutil.TempFile("", "ctat-leaf-hashes")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(v.hashes.Name())
+		defer v.hashes.Close()
+	}
+
+	entries, err := common.LoadCacheFile(cacheFile)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+	fmt.Println("hashing entries in local cache...")
+	count, err := v.hashEntries(entries)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("local entries: %d, stored STHs: %d\n", count, len(sths))
+	if v.badEntries > 0 {
+		fmt.Printf("%d entries failed to parse, the first at index %d\n", v.badEntries, v.firstBadIdx)
+	}
+
+	good := uint64(0)
+	for _, sth := range sths {
+		if sth.TreeSize > count {
+			break
+		}
+		root, err := sth.Root()
+		if err != nil {
+			return fmt.Errorf("stored STH is malformed: %s", err)
+		}
+		if v.states[sth.TreeSize].Root() != root {
+			fmt.Printf("root of first %d entries doesn't match STH from %s\n", sth.TreeSize, sth.Time())
+			if logURI == "" {
+				return fmt.Errorf("cache diverges from log between index %d and %d (use --logURI to find exact index)", good, sth.TreeSize-1)
+			}
+			index, err := v.narrow(logURI, good, sth.TreeSize, sth)
+			if err != nil {
+				return fmt.Errorf("failed to narrow down diverging entry: %s", err)
+			}
+			return fmt.Errorf("cache diverges from log at index %d", index)
+		}
+		fmt.Printf("root of first %d entries matches STH from %s\n", sth.TreeSize, sth.Time())
+		good = sth.TreeSize
+	}
+
+	latest := sths[len(sths)-1]
+	if count < latest.TreeSize {
+		if logURI == "" {
+			return fmt.Errorf("cache has %d entries but the latest STH has %d, entries after index %d are unverified (use --logURI to check them)", count, latest.TreeSize, good)
+		}
+		ok, err := v.consistentPrefix(logURI, v.states[good], count, latest)
+		if err != nil {
+			return fmt.Errorf("failed to check cache against log: %s", err)
+		}
+		if ok {
+			return fmt.Errorf("cache is truncated, entries from index %d onwards are missing", count)
+		}
+		index, err := v.narrow(logURI, good, count, latest)
+		if err != nil {
+			return fmt.Errorf("failed to narrow down diverging entry: %s", err)
+		}
+		return fmt.Errorf("cache diverges from log at index %d", index)
+	}
+	if count > latest.TreeSize {
+		fmt.Printf("%d entries after the latest STH are unverified\n", count-latest.TreeSize)
+	}
+	if v.badEntries > 0 {
+		return fmt.Errorf("tree matches but %d entries couldn't be parsed", v.badEntries)
+	}
+	fmt.Println("cache matches stored STHs")
+	return nil
+}
+
+type sthsBySize []*common.SignedTreeHead
+
+func (s sthsBySize) Len() int           { return len(s) }
+func (s sthsBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s sthsBySize) Less(i, j int) bool { return s[i].TreeSize < s[j].TreeSize }
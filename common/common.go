@@ -3,62 +3,314 @@ package common
 import (
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/rolandshoemaker/ctat/filter"
 
 	ct "github.com/rolandshoemaker/certificatetransparency"
 )
 
-func escape(str string) string {
-	return strings.Replace(str, ",", " -", -1)
+// SubjectToString formats a name the way issuers and subjects are shown in
+// stats and graphs, it lives in filter so issuer filters can match on it
+func SubjectToString(subject pkix.Name) string {
+	return filter.SubjectToString(subject)
 }
 
-func SubjectToString(subject pkix.Name) string {
-	out := []string{}
-	if subject.CommonName != "" {
-		out = append(out, fmt.Sprintf("CN=%s", escape(subject.CommonName)))
+// RunFilters checks a certificate against filters, ent is the entry it came
+// from or nil
+func RunFilters(ent *ct.EntryAndPosition, cert *x509.Certificate, filters []filter.EntryFilter) (*x509.Certificate, bool, error) {
+	skippedBy, err := firstSkip(ent, cert, filters)
+	if err != nil || skippedBy >= 0 {
+		return nil, skippedBy >= 0, err
+	}
+	return cert, false, nil
+}
+
+// firstSkip returns the index of the first filter that skips cert, or -1 if
+// they all keep it
+func firstSkip(ent *ct.EntryAndPosition, cert *x509.Certificate, filters []filter.EntryFilter) (int, error) {
+	for i, f := range filters {
+		skip, err := f(ent, cert)
+		if err != nil {
+			return -1, err
+		}
+		if skip {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+func ParseAndFilter(ent *ct.EntryAndPosition, rawCert []byte, filters []filter.EntryFilter) (*x509.Certificate, bool, error) {
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		return nil, false, err
+	}
+	return RunFilters(ent, cert, filters)
+}
+
+var poisonOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+
+// IsPrecert checks if a certificate contains the CT poison extension
+func IsPrecert(cert *x509.Certificate) bool {
+	for _, e := range cert.Extensions {
+		if e.Id.Equal(poisonOID) {
+			return true
+		}
 	}
-	if len(subject.Organization) != 0 {
-		out = append(out, fmt.Sprintf("O=[%s]", escape(strings.Join(subject.Organization, " -- "))))
+	return false
+}
+
+// ParsePrecert parses the TBSCertificate from a precertificate entry. The TBS
+// is wrapped in a Certificate with an empty signature, using the signature
+// algorithm from the TBS itself, so it can be parsed by crypto/x509. The poison
+// extension is removed in case the log didn't strip it.
+func ParsePrecert(tbs []byte) (*x509.Certificate, error) {
+	var tbsSeq asn1.RawValue
+	if rest, err := asn1.Unmarshal(tbs, &tbsSeq); err != nil {
+		return nil, fmt.Errorf("malformed precertificate TBS: %s", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("trailing data after precertificate TBS")
 	}
-	if len(subject.OrganizationalUnit) != 0 {
-		out = append(out, fmt.Sprintf("OU=[%s]", escape(strings.Join(subject.OrganizationalUnit, " -- "))))
+	// version (optional), serial number, signature algorithm
+	var sigAlg asn1.RawValue
+	fields := tbsSeq.Bytes
+	for i := 0; i < 3 && len(fields) > 0; i++ {
+		var field asn1.RawValue
+		rest, err := asn1.Unmarshal(fields, &field)
+		if err != nil {
+			return nil, fmt.Errorf("malformed precertificate TBS: %s", err)
+		}
+		fields = rest
+		if field.Class == asn1.ClassUniversal && field.Tag == asn1.TagSequence {
+			sigAlg = field
+			break
+		}
 	}
-	if len(subject.Locality) != 0 {
-		out = append(out, fmt.Sprintf("L=[%s]", escape(strings.Join(subject.Locality, " -- "))))
+	if sigAlg.FullBytes == nil {
+		return nil, fmt.Errorf("precertificate TBS has no signature algorithm")
+	}
+	der, err := asn1.Marshal(struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}{asn1.RawValue{FullBytes: tbs}, sigAlg, asn1.BitString{}})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
 	}
-	if len(subject.Province) != 0 {
-		out = append(out, fmt.Sprintf("ST=[%s]", escape(strings.Join(subject.Province, " -- "))))
+	extensions := cert.Extensions[:0]
+	for _, e := range cert.Extensions {
+		if !e.Id.Equal(poisonOID) {
+			extensions = append(extensions, e)
+		}
 	}
-	if len(subject.Country) != 0 {
-		out = append(out, fmt.Sprintf("C=[%s]", escape(strings.Join(subject.Country, " -- "))))
+	cert.Extensions = extensions
+	unhandled := cert.UnhandledCriticalExtensions[:0]
+	for _, oid := range cert.UnhandledCriticalExtensions {
+		if !oid.Equal(poisonOID) {
+			unhandled = append(unhandled, oid)
+		}
 	}
-	if len(out) == 0 {
-		return "???"
+	cert.UnhandledCriticalExtensions = unhandled
+	return cert, nil
+}
+
+// ParseEntry parses the certificate, or precertificate TBS, logged in entry
+func ParseEntry(entry *ct.Entry) (*x509.Certificate, error) {
+	switch entry.Type {
+	case ct.X509Entry:
+		return x509.ParseCertificate(entry.X509Cert)
+	case ct.PreCertEntry:
+		return ParsePrecert(entry.TBSCert)
 	}
-	return strings.Join(out, "; ")
+	return nil, fmt.Errorf("unknown entry type %d", entry.Type)
 }
 
-func ParseAndFilter(rawCert []byte, filters []filter.Filter) (*x509.Certificate, bool, error) {
-	cert, err := x509.ParseCertificate(rawCert)
+// ParseEntryAndFilter is ParseAndFilter for log entries, precertificate entries
+// are skipped unless includePrecerts is set. If drops isn't nil it records why
+// the entry was dropped (only the first filter to skip an entry is counted),
+// filters must be the ones drops was created for.
+func ParseEntryAndFilter(ent *ct.EntryAndPosition, filters []filter.EntryFilter, includePrecerts bool, drops *Drops) (*x509.Certificate, bool, error) {
+	if drops != nil {
+		atomic.AddInt64(&drops.Entries, 1)
+	}
+	if ent.Entry.Type == ct.PreCertEntry && !includePrecerts {
+		if drops != nil {
+			atomic.AddInt64(&drops.Precerts, 1)
+		}
+		return nil, true, nil
+	}
+	cert, err := ParseEntry(ent.Entry)
 	if err != nil {
+		if drops != nil {
+			atomic.AddInt64(&drops.CertErrors, 1)
+		}
 		return nil, false, err
 	}
-	for _, f := range filters {
-		if skip, err := f(cert); skip || err != nil {
-			return nil, skip, err
+	skippedBy, err := firstSkip(ent, cert, filters)
+	if err != nil {
+		if drops != nil {
+			atomic.AddInt64(&drops.FilterErrors, 1)
 		}
+		return nil, false, err
+	}
+	if skippedBy >= 0 {
+		if drops != nil {
+			atomic.AddInt64(&drops.Filtered[skippedBy].Dropped, 1)
+		}
+		return nil, true, nil
+	}
+	if drops != nil {
+		atomic.AddInt64(&drops.Kept, 1)
 	}
 	return cert, false, nil
 }
 
-func LoadCacheFile(filename string) (*ct.EntriesFile, error) {
+// LoadCacheFile opens a cache file for reading, compressed cache files are
+// decompressed on the fly so they can't be seeked
+func LoadCacheFile(filename string) (*CacheFile, error) {
 	ctFile, err := os.OpenFile(filename, os.O_RDONLY, 0666)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open CT cache file: %s", err)
 	}
-	return &ct.EntriesFile{File: ctFile}, nil
+	compressed, err := isGzip(ctFile)
+	if err != nil {
+		ctFile.Close()
+		return nil, fmt.Errorf("failed to read CT cache file: %s", err)
+	}
+	if compressed {
+		pr, d, err := decompressPipe(ctFile)
+		if err != nil {
+			ctFile.Close()
+			return nil, err
+		}
+		return &CacheFile{EntriesFile: &ct.EntriesFile{File: pr}, decompressed: d}, nil
+	}
+	return &CacheFile{EntriesFile: &ct.EntriesFile{File: ctFile}}, nil
+}
+
+// MapSection runs callback for each entry in length bytes of file starting at
+// offset, which must be the start of an entry. The section is streamed through
+// a pipe so entries can be read from anywhere in a cache without scanning it
+// from the start. Indexes and offsets passed to callback are relative to the
+// start of the section.
+func MapSection(file *os.File, offset, length int64, callback func(*ct.EntryAndPosition, error)) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	copyErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(pw, io.NewSectionReader(file, offset, length))
+		pw.Close()
+		copyErr <- err
+	}()
+	err = ct.EntriesFile{File: pr}.Map(callback)
+	// unblocks the copy if Map gave up early
+	pr.Close()
+	if cErr := <-copyErr; err == nil && cErr != nil {
+		return cErr
+	}
+	return err
+}
+
+// WriteEntry writes a log entry in the EntriesFile layout, the leaf input and
+// extra data each prefixed with their big-endian uint32 length
+func WriteEntry(w io.Writer, leafInput, extraData []byte) error {
+	record := make([]byte, 0, 8+len(leafInput)+len(extraData))
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(leafInput)))
+	record = append(append(record, length[:]...), leafInput...)
+	binary.BigEndian.PutUint32(length[:], uint32(len(extraData)))
+	record = append(append(record, length[:]...), extraData...)
+	_, err := w.Write(record)
+	return err
+}
+
+// OrderedMap is EntriesFile.Map but callback is run for each entry in index
+// order, entries that arrive early are held until the ones before them have
+// been mapped. Errors that come without a position are passed straight on.
+func OrderedMap(entries *CacheFile, callback func(*ct.EntryAndPosition, error)) error {
+	type mapped struct {
+		ent *ct.EntryAndPosition
+		err error
+	}
+	mu := new(sync.Mutex)
+	pending := make(map[uint64]mapped)
+	next := uint64(0)
+	err := entries.Map(func(ent *ct.EntryAndPosition, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ent == nil {
+			callback(nil, err)
+			return
+		}
+		pending[ent.Index] = mapped{ent, err}
+		for {
+			m, present := pending[next]
+			if !present {
+				return
+			}
+			delete(pending, next)
+			callback(m.ent, m.err)
+			next++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("cache file has a gap in its entry indexes at index %d", next)
+	}
+	return nil
+}
+
+func putUint24(b []byte, n int) []byte {
+	return append(b, byte(n>>16), byte(n>>8), byte(n))
+}
+
+func marshalChain(certs [][]byte) []byte {
+	body := []byte{}
+	for _, c := range certs {
+		body = append(putUint24(body, len(c)), c...)
+	}
+	return append(putUint24(nil, len(body)), body...)
+}
+
+// MarshalLeaf builds the MerkleTreeLeaf for an entry, leaf extensions aren't
+// kept in ct.Entry so they are always empty
+func MarshalLeaf(entry *ct.Entry) []byte {
+	leaf := make([]byte, 12)
+	leaf[0] = 0 // v1
+	leaf[1] = 0 // timestamped_entry
+	binary.BigEndian.PutUint64(leaf[2:], entry.Timestamp)
+	binary.BigEndian.PutUint16(leaf[10:], uint16(entry.Type))
+	switch entry.Type {
+	case ct.X509Entry:
+		leaf = append(putUint24(leaf, len(entry.X509Cert)), entry.X509Cert...)
+	case ct.PreCertEntry:
+		leaf = append(leaf, entry.PreCertIssuerKeyHash[:]...)
+		leaf = append(putUint24(leaf, len(entry.TBSCert)), entry.TBSCert...)
+	}
+	return append(leaf, 0, 0)
+}
+
+// ExtraData rebuilds the extra_data a log would have served for an entry
+func ExtraData(entry *ct.Entry) []byte {
+	if entry.Type == ct.PreCertEntry && len(entry.ExtraCerts) > 0 {
+		// PrecertChainEntry, the precertificate followed by its chain
+		pre := entry.ExtraCerts[0]
+		return append(append(putUint24(nil, len(pre)), pre...), marshalChain(entry.ExtraCerts[1:])...)
+	}
+	return marshalChain(entry.ExtraCerts)
 }
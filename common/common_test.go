@@ -0,0 +1,92 @@
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// TestWriteEntryRoundTrip checks that entries written by WriteEntry, which
+// download, tiled download, and convert all use, are read back unchanged by
+// the library's EntriesFile.Map
+func TestWriteEntryRoundTrip(t *testing.T) {
+	var keyHash [32]byte
+	copy(keyHash[:], bytes.Repeat([]byte{0xaa}, 32))
+	entries := []*ct.Entry{
+		{
+			Timestamp:  1451606400000,
+			Type:       ct.X509Entry,
+			X509Cert:   []byte("leaf certificate"),
+			ExtraCerts: [][]byte{[]byte("intermediate"), []byte("root")},
+		},
+		{
+			Timestamp:            1451606400001,
+			Type:                 ct.PreCertEntry,
+			PreCertIssuerKeyHash: keyHash,
+			TBSCert:              []byte("tbs certificate"),
+			ExtraCerts:           [][]byte{[]byte("precertificate"), []byte("intermediate")},
+		},
+		{
+			Timestamp: 1451606400002,
+			Type:      ct.X509Entry,
+			X509Cert:  bytes.Repeat([]byte{1}, 70000),
+		},
+	}
+
+	f, err := ioutil.TempFile("", "ctat-entries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	lengths := []int{}
+	for _, e := range entries {
+		leaf, extra := MarshalLeaf(e), ExtraData(e)
+		if err = WriteEntry(f, leaf, extra); err != nil {
+			t.Fatal(err)
+		}
+		lengths = append(lengths, 8+len(leaf)+len(extra))
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	mu := new(sync.Mutex)
+	read := make(map[uint64]*ct.EntryAndPosition)
+	err = ct.EntriesFile{File: f}.Map(func(ent *ct.EntryAndPosition, err error) {
+		if err != nil {
+			t.Errorf("failed to read entry: %s", err)
+			return
+		}
+		mu.Lock()
+		read[ent.Index] = ent
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("read %d entries, wrote %d", len(read), len(entries))
+	}
+	offset := int64(0)
+	for i, expected := range entries {
+		ent := read[uint64(i)]
+		if ent == nil {
+			t.Fatalf("entry %d missing", i)
+		}
+		if ent.Offset != offset || ent.Length != lengths[i] {
+			t.Errorf("entry %d at offset %d length %d, expected offset %d length %d", i, ent.Offset, ent.Length, offset, lengths[i])
+		}
+		offset += int64(lengths[i])
+		if !bytes.Equal(MarshalLeaf(ent.Entry), MarshalLeaf(expected)) {
+			t.Errorf("entry %d leaf input changed", i)
+		}
+		if !bytes.Equal(ExtraData(ent.Entry), ExtraData(expected)) {
+			t.Errorf("entry %d extra data changed", i)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// Compressed cache files are a series of gzip members each holding a run of
+// whole entries, decompressed they are identical to an uncompressed cache.
+// New entries are appended as new members so compressed caches can still be
+// updated by download, but they can't be read at arbitrary offsets which rules
+// out indexes and anything else that seeks.
+
+func isGzip(file *os.File) (bool, error) {
+	magic := make([]byte, 2)
+	n, err := file.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	// the first bytes of an uncompressed cache are the length of the first
+	// leaf, which is never large enough to look like the gzip magic
+	return n == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// IsCompressed checks whether a cache file is compressed
+func IsCompressed(cacheFilename string) (bool, error) {
+	file, err := os.Open(cacheFilename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return isGzip(file)
+}
+
+// RequireUncompressed returns an error if a cache file is compressed, for
+// operations that need to seek in the cache
+func RequireUncompressed(cacheFilename string) error {
+	compressed, err := IsCompressed(cacheFilename)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		return fmt.Errorf("%s is compressed, use 'cache decompress' first", cacheFilename)
+	}
+	return nil
+}
+
+// CompressEntries compresses a run of entries as a single gzip member that
+// can be appended to a compressed cache
+func CompressEntries(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CacheFile is a cache file opened by LoadCacheFile
+type CacheFile struct {
+	*ct.EntriesFile
+	decompressed *decompression
+}
+
+type decompression struct {
+	done chan struct{}
+	err  error
+}
+
+// Compressed reports whether the cache file is being decompressed as it's read
+func (cf *CacheFile) Compressed() bool {
+	return cf.decompressed != nil
+}
+
+// Map maps over the entries in the cache file like EntriesFile.Map, but also
+// returns any error hit decompressing a compressed cache, which Map would
+// otherwise just see as the entries ending early
+func (cf *CacheFile) Map(callback func(*ct.EntryAndPosition, error)) error {
+	err := cf.EntriesFile.Map(callback)
+	if cf.decompressed == nil {
+		return err
+	}
+	if err == nil {
+		// Map read the pipe to the end so decompression has finished
+		<-cf.decompressed.done
+		return cf.decompressed.err
+	}
+	select {
+	case <-cf.decompressed.done:
+		if cf.decompressed.err != nil {
+			return cf.decompressed.err
+		}
+	default:
+	}
+	return err
+}
+
+// decompressPipe returns a pipe that file is decompressed into, so compressed
+// caches can be passed to EntriesFile.Map which needs an *os.File. file is
+// closed once it has been read or the pipe is closed.
+func decompressPipe(file *os.File) (*os.File, *decompression, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	d := &decompression{done: make(chan struct{})}
+	go func() {
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		if err == nil {
+			_, err = io.Copy(pw, gz)
+		}
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EPIPE {
+			// the reader stopped early
+			err = nil
+		}
+		if err != nil {
+			d.err = fmt.Errorf("failed to decompress %s: %s", file.Name(), err)
+		}
+		close(d.done)
+		pw.Close()
+	}()
+	return pr, d, nil
+}
+
+// countCompressed counts the entries in a compressed cache by mapping over a
+// separate decompressed stream, since the stream can't be rewound afterwards
+func countCompressed(cacheFilename string) (uint64, error) {
+	entries, err := LoadCacheFile(cacheFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer entries.Close()
+	count := uint64(0)
+	err = entries.Map(func(ent *ct.EntryAndPosition, err error) {
+		if ent != nil {
+			atomic.AddUint64(&count, 1)
+		}
+	})
+	return count, err
+}
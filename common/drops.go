@@ -0,0 +1,90 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+type FilterDrops struct {
+	Filter  string
+	Dropped int64
+}
+
+// Drops counts why entries were dropped before reaching metrics or scanners,
+// parse failures are kept separate from entries that were filtered out and
+// each filter gets its own count (an entry is only counted against the first
+// filter that skips it)
+type Drops struct {
+	Entries int64
+	Kept    int64
+
+	EntryErrors  int64
+	CertErrors   int64
+	FilterErrors int64
+	Precerts     int64
+
+	Filtered []FilterDrops
+}
+
+// NewDrops creates a Drops for a list of filters, names are used to report
+// what each filter dropped
+func NewDrops(names []string) *Drops {
+	d := &Drops{Filtered: make([]FilterDrops, len(names))}
+	for i, name := range names {
+		d.Filtered[i].Filter = name
+	}
+	return d
+}
+
+// EntryError records a CT entry that couldn't be parsed
+func (d *Drops) EntryError() {
+	atomic.AddInt64(&d.Entries, 1)
+	atomic.AddInt64(&d.EntryErrors, 1)
+}
+
+// Merge adds the counts from another Drops, filters are matched up by name
+func (d *Drops) Merge(other *Drops) {
+	d.Entries += other.Entries
+	d.Kept += other.Kept
+	d.EntryErrors += other.EntryErrors
+	d.CertErrors += other.CertErrors
+	d.FilterErrors += other.FilterErrors
+	d.Precerts += other.Precerts
+	for _, f := range other.Filtered {
+		found := false
+		for i := range d.Filtered {
+			if d.Filtered[i].Filter == f.Filter {
+				d.Filtered[i].Dropped += f.Dropped
+				found = true
+				break
+			}
+		}
+		if !found {
+			d.Filtered = append(d.Filtered, f)
+		}
+	}
+}
+
+func (d *Drops) Print(out io.Writer) {
+	percent := func(n int64) float64 {
+		if d.Entries == 0 {
+			return 0
+		}
+		return float64(n) / float64(d.Entries) * 100.0
+	}
+	fmt.Fprintln(out, "# Dropped entries")
+	w := new(tabwriter.Writer)
+	w.Init(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "entries\t%d\t\n", d.Entries)
+	fmt.Fprintf(w, "kept\t%d\t(%.2f%%)\n", d.Kept, percent(d.Kept))
+	fmt.Fprintf(w, "unparseable CT entries\t%d\t(%.2f%%)\n", d.EntryErrors, percent(d.EntryErrors))
+	fmt.Fprintf(w, "unparseable certificates\t%d\t(%.2f%%)\n", d.CertErrors, percent(d.CertErrors))
+	fmt.Fprintf(w, "filter errors\t%d\t(%.2f%%)\n", d.FilterErrors, percent(d.FilterErrors))
+	fmt.Fprintf(w, "skipped precertificates\t%d\t(%.2f%%)\n", d.Precerts, percent(d.Precerts))
+	for _, f := range d.Filtered {
+		fmt.Fprintf(w, "filtered by %s\t%d\t(%.2f%%)\n", f.Filter, f.Dropped, percent(f.Dropped))
+	}
+	w.Flush()
+}
@@ -0,0 +1,302 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// Index is a sidecar file mapping entry indexes in a cache file to byte
+// offsets. It is a list of big-endian uint64 offsets, one for the start of
+// each entry followed by the end of the last entry, so entry i spans
+// [offset i, offset i+1).
+type Index struct {
+	file  *os.File
+	count uint64
+	end   int64
+}
+
+func IndexFilename(cacheFilename string) string {
+	return cacheFilename + ".idx"
+}
+
+// OpenIndex opens the index for a cache file, if there is no index nil is
+// returned
+func OpenIndex(cacheFilename string) (*Index, error) {
+	file, err := os.OpenFile(IndexFilename(cacheFilename), os.O_RDWR, 0666)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	idx := &Index{file: file}
+	if err = idx.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+func (idx *Index) load() error {
+	info, err := idx.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		// new index, the first entry starts at the beginning of the file
+		var zero [8]byte
+		_, err = idx.file.WriteAt(zero[:], 0)
+		return err
+	}
+	if info.Size()%8 != 0 {
+		return fmt.Errorf("index file has invalid size %d", info.Size())
+	}
+	idx.count = uint64(info.Size()/8) - 1
+	idx.end, err = idx.Offset(idx.count)
+	return err
+}
+
+func (idx *Index) Close() error {
+	return idx.file.Close()
+}
+
+// Count returns the number of entries in the index
+func (idx *Index) Count() uint64 {
+	return idx.count
+}
+
+// End returns the offset of the end of the last indexed entry
+func (idx *Index) End() int64 {
+	return idx.end
+}
+
+// Offset returns the offset of entry i, or for i == Count() the end of the
+// last entry
+func (idx *Index) Offset(i uint64) (int64, error) {
+	if i > idx.count {
+		return 0, fmt.Errorf("entry %d is past the end of the index", i)
+	}
+	var buf [8]byte
+	if _, err := idx.file.ReadAt(buf[:], int64(i)*8); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(buf[:])), nil
+}
+
+// Range returns the offset and length of the entries [start, end)
+func (idx *Index) Range(start, end uint64) (int64, int64, error) {
+	if start > end {
+		return 0, 0, fmt.Errorf("invalid range %d-%d", start, end)
+	}
+	startOffset, err := idx.Offset(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	endOffset, err := idx.Offset(end)
+	if err != nil {
+		return 0, 0, err
+	}
+	return startOffset, endOffset - startOffset, nil
+}
+
+// Append adds entries to the index given the offset of the end of each one
+func (idx *Index) Append(ends []int64) error {
+	if len(ends) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, len(ends)*8)
+	var offset [8]byte
+	for _, e := range ends {
+		binary.BigEndian.PutUint64(offset[:], uint64(e))
+		buf = append(buf, offset[:]...)
+	}
+	if _, err := idx.file.WriteAt(buf, int64(idx.count+1)*8); err != nil {
+		return err
+	}
+	idx.count += uint64(len(ends))
+	idx.end = ends[len(ends)-1]
+	return nil
+}
+
+// Truncate drops all entries after the first count
+func (idx *Index) Truncate(count uint64) error {
+	if count >= idx.count {
+		return nil
+	}
+	if err := idx.file.Truncate(int64(count+1) * 8); err != nil {
+		return err
+	}
+	idx.count = count
+	end, err := idx.Offset(count)
+	if err != nil {
+		return err
+	}
+	idx.end = end
+	return nil
+}
+
+// extend indexes the entries in file after the end of the index
+func (idx *Index) extend(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == idx.end {
+		return nil
+	}
+	if info.Size() < idx.end {
+		// the cache file has been truncated, drop the entries that are
+		// past the end of it
+		lo, hi := uint64(0), idx.count
+		for lo < hi {
+			mid := lo + (hi-lo+1)/2
+			offset, err := idx.Offset(mid)
+			if err != nil {
+				return err
+			}
+			if offset <= info.Size() {
+				lo = mid
+			} else {
+				hi = mid - 1
+			}
+		}
+		if err = idx.Truncate(lo); err != nil {
+			return err
+		}
+	}
+	base, start := idx.end, idx.count
+	mu := new(sync.Mutex)
+	var mapErr error
+	added := uint64(0)
+	var last int64
+	err = MapSection(file, base, info.Size()-base, func(ent *ct.EntryAndPosition, err error) {
+		if ent == nil {
+			mu.Lock()
+			mapErr = fmt.Errorf("failed to read entry: %s", err)
+			mu.Unlock()
+			return
+		}
+		// entries may be mapped out of order so each end is written to
+		// its own slot
+		end := base + ent.Offset + int64(ent.Length)
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(end))
+		_, wErr := idx.file.WriteAt(buf[:], int64(start+ent.Index+1)*8)
+		mu.Lock()
+		defer mu.Unlock()
+		if wErr != nil {
+			mapErr = wErr
+		}
+		added++
+		if end > last {
+			last = end
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if mapErr != nil {
+		return mapErr
+	}
+	idx.count += added
+	idx.end = last
+	return nil
+}
+
+// UpdateIndex creates the index for a cache file if it doesn't exist and
+// indexes any entries in the cache file that aren't already
+func UpdateIndex(cacheFilename string) (*Index, error) {
+	if err := RequireUncompressed(cacheFilename); err != nil {
+		return nil, err
+	}
+	idx, err := OpenIndex(cacheFilename)
+	if err != nil {
+		return nil, err
+	}
+	if idx == nil {
+		file, err := os.OpenFile(IndexFilename(cacheFilename), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		idx = &Index{file: file}
+		if err = idx.load(); err != nil {
+			idx.Close()
+			return nil, err
+		}
+	}
+	cacheFile, err := os.Open(cacheFilename)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	defer cacheFile.Close()
+	if err = idx.extend(cacheFile); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// MapRange runs callback for each entry in [start, end) using the index to
+// find them, indexes passed to callback are absolute
+func (idx *Index) MapRange(file *os.File, start, end uint64, callback func(*ct.EntryAndPosition, error)) error {
+	offset, length, err := idx.Range(start, end)
+	if err != nil {
+		return err
+	}
+	return MapSection(file, offset, length, func(ent *ct.EntryAndPosition, err error) {
+		if ent != nil {
+			ent.Index += start
+			ent.Offset += offset
+		}
+		callback(ent, err)
+	})
+}
+
+// OpenCurrentIndex opens the index for a cache file only if it covers the
+// whole file
+func OpenCurrentIndex(cacheFilename string) (*Index, error) {
+	if compressed, err := IsCompressed(cacheFilename); err != nil || compressed {
+		return nil, err
+	}
+	idx, err := OpenIndex(cacheFilename)
+	if err != nil || idx == nil {
+		return nil, err
+	}
+	info, err := os.Stat(cacheFilename)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if info.Size() != idx.End() {
+		idx.Close()
+		return nil, nil
+	}
+	return idx, nil
+}
+
+// CountEntries counts the entries in a cache file, using its index if it has
+// an up to date one instead of reading the whole file. The file is left
+// positioned at the start.
+func CountEntries(entries *ct.EntriesFile, cacheFilename string) (uint64, error) {
+	if compressed, err := IsCompressed(cacheFilename); err != nil {
+		return 0, err
+	} else if compressed {
+		return countCompressed(cacheFilename)
+	}
+	idx, err := OpenCurrentIndex(cacheFilename)
+	if err == nil && idx != nil {
+		defer idx.Close()
+		return idx.Count(), nil
+	}
+	count, err := entries.Count()
+	if err != nil {
+		return 0, err
+	}
+	_, err = entries.File.Seek(0, 0)
+	return count, err
+}
@@ -0,0 +1,167 @@
+package common
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// LeafHash and NodeHash are the RFC 6962 Merkle tree hash functions
+func LeafHash(leaf []byte) [32]byte {
+	return sha256.Sum256(append([]byte{0}, leaf...))
+}
+
+func NodeHash(left, right [32]byte) [32]byte {
+	data := make([]byte, 65)
+	data[0] = 1
+	copy(data[1:], left[:])
+	copy(data[33:], right[:])
+	return sha256.Sum256(data)
+}
+
+// VerifyConsistency checks that proof shows the tree of size second with root
+// secondRoot is an append-only extension of the tree of size first with root
+// firstRoot. This is the verification algorithm from RFC 9162 section 2.1.4.2
+// which is equivalent to the one implied by RFC 6962.
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot [32]byte, proof [][32]byte) error {
+	if first > second {
+		return fmt.Errorf("tree size %d is smaller than %d", second, first)
+	}
+	if first == second {
+		if len(proof) != 0 {
+			return fmt.Errorf("non-empty proof for trees of the same size")
+		}
+		if firstRoot != secondRoot {
+			return fmt.Errorf("trees of size %d have different roots", first)
+		}
+		return nil
+	}
+	if first == 0 {
+		// the empty tree is consistent with everything
+		if len(proof) != 0 {
+			return fmt.Errorf("non-empty proof for empty tree")
+		}
+		return nil
+	}
+	if len(proof) == 0 {
+		return fmt.Errorf("empty proof")
+	}
+	if first&(first-1) == 0 {
+		proof = append([][32]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("proof is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return fmt.Errorf("proof is too short")
+	}
+	if fr != firstRoot {
+		return fmt.Errorf("proof doesn't match root of tree of size %d", first)
+	}
+	if sr != secondRoot {
+		return fmt.Errorf("proof doesn't match root of tree of size %d", second)
+	}
+	return nil
+}
+
+// ConsistencyProof builds the proof that the tree of size second is an
+// extension of the tree of size first, subtree returns the Merkle tree hash
+// of the leaves [start, end)
+func ConsistencyProof(first, second uint64, subtree func(start, end uint64) ([32]byte, error)) ([][32]byte, error) {
+	if first == 0 || first >= second {
+		return nil, nil
+	}
+	return subproof(first, 0, second, true, subtree)
+}
+
+// subproof is SUBPROOF from RFC 6962 section 2.1.2 for the leaves [start, end)
+func subproof(m, start, end uint64, complete bool, subtree func(uint64, uint64) ([32]byte, error)) ([][32]byte, error) {
+	n := end - start
+	if m == n {
+		if complete {
+			return nil, nil
+		}
+		h, err := subtree(start, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][32]byte{h}, nil
+	}
+	k := uint64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	var proof [][32]byte
+	var h [32]byte
+	var err error
+	if m <= k {
+		proof, err = subproof(m, start, start+k, complete, subtree)
+		if err == nil {
+			h, err = subtree(start+k, end)
+		}
+	} else {
+		proof, err = subproof(m-k, start+k, end, false, subtree)
+		if err == nil {
+			h, err = subtree(start, start+k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, h), nil
+}
+
+// TreeHasher incrementally computes the Merkle tree hash of a sequence of leaf
+// hashes using only O(log n) memory
+type TreeHasher struct {
+	size uint64
+	// roots of the perfect subtrees that make up the tree, largest first
+	stack [][32]byte
+}
+
+func (th *TreeHasher) Add(leafHash [32]byte) {
+	th.stack = append(th.stack, leafHash)
+	for s := th.size; s&1 == 1; s >>= 1 {
+		n := len(th.stack)
+		th.stack = append(th.stack[:n-2], NodeHash(th.stack[n-2], th.stack[n-1]))
+	}
+	th.size++
+}
+
+func (th *TreeHasher) Size() uint64 {
+	return th.size
+}
+
+func (th *TreeHasher) Root() [32]byte {
+	if len(th.stack) == 0 {
+		return sha256.Sum256(nil)
+	}
+	root := th.stack[len(th.stack)-1]
+	for i := len(th.stack) - 2; i >= 0; i-- {
+		root = NodeHash(th.stack[i], root)
+	}
+	return root
+}
+
+func (th *TreeHasher) Copy() *TreeHasher {
+	return &TreeHasher{size: th.size, stack: append([][32]byte{}, th.stack...)}
+}
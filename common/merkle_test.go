@@ -0,0 +1,184 @@
+package common
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// the eight leaves and tree roots used by the RFC 6962 test vectors in the
+// certificate-transparency reference implementation
+var testLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var testRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var testProofs = []struct {
+	first, second uint64
+	proof         []string
+}{
+	{1, 1, nil},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func decodeHash(t *testing.T, h string) [32]byte {
+	var hash [32]byte
+	decoded, err := hex.DecodeString(h)
+	if err != nil || len(decoded) != 32 {
+		t.Fatalf("bad test hash %q", h)
+	}
+	copy(hash[:], decoded)
+	return hash
+}
+
+func testLeafHashes(t *testing.T) [][32]byte {
+	hashes := [][32]byte{}
+	for _, l := range testLeaves {
+		leaf, err := hex.DecodeString(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, LeafHash(leaf))
+	}
+	return hashes
+}
+
+func testSubtree(hashes [][32]byte) func(start, end uint64) ([32]byte, error) {
+	return func(start, end uint64) ([32]byte, error) {
+		th := new(TreeHasher)
+		for _, h := range hashes[start:end] {
+			th.Add(h)
+		}
+		return th.Root(), nil
+	}
+}
+
+func TestTreeHasherRoots(t *testing.T) {
+	th := new(TreeHasher)
+	if th.Root() != decodeHash(t, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
+		t.Error("wrong root for the empty tree")
+	}
+	for i, h := range testLeafHashes(t) {
+		th.Add(h)
+		if th.Root() != decodeHash(t, testRoots[i]) {
+			t.Errorf("wrong root for tree of size %d", i+1)
+		}
+	}
+}
+
+func TestVerifyConsistencyVectors(t *testing.T) {
+	for _, tc := range testProofs {
+		proof := [][32]byte{}
+		for _, h := range tc.proof {
+			proof = append(proof, decodeHash(t, h))
+		}
+		firstRoot, secondRoot := decodeHash(t, testRoots[tc.first-1]), decodeHash(t, testRoots[tc.second-1])
+		if err := VerifyConsistency(tc.first, tc.second, firstRoot, secondRoot, proof); err != nil {
+			t.Errorf("%d -> %d: valid proof rejected: %s", tc.first, tc.second, err)
+		}
+		generated, err := ConsistencyProof(tc.first, tc.second, testSubtree(testLeafHashes(t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(generated) != len(proof) {
+			t.Errorf("%d -> %d: generated proof has %d hashes, expected %d", tc.first, tc.second, len(generated), len(proof))
+			continue
+		}
+		for i := range proof {
+			if generated[i] != proof[i] {
+				t.Errorf("%d -> %d: generated proof differs at %d", tc.first, tc.second, i)
+			}
+		}
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	hashes := testLeafHashes(t)
+	subtree := testSubtree(hashes)
+	roots := [][32]byte{}
+	for i := range testRoots {
+		roots = append(roots, decodeHash(t, testRoots[i]))
+	}
+	root := func(size uint64) [32]byte {
+		if size == 0 {
+			return new(TreeHasher).Root()
+		}
+		return roots[size-1]
+	}
+	for first := uint64(0); first <= 8; first++ {
+		for second := first; second <= 8; second++ {
+			proof, err := ConsistencyProof(first, second, subtree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = VerifyConsistency(first, second, root(first), root(second), proof); err != nil {
+				t.Errorf("%d -> %d: valid proof rejected: %s", first, second, err)
+			}
+			if first == 0 || first == second {
+				if len(proof) != 0 {
+					t.Errorf("%d -> %d: expected an empty proof", first, second)
+				}
+				if err = VerifyConsistency(first, second, root(first), root(second), [][32]byte{root(first)}); err == nil {
+					t.Errorf("%d -> %d: non-empty proof accepted", first, second)
+				}
+				continue
+			}
+			for i := range proof {
+				tampered := append([][32]byte{}, proof...)
+				tampered[i][0] ^= 1
+				if VerifyConsistency(first, second, root(first), root(second), tampered) == nil {
+					t.Errorf("%d -> %d: proof with hash %d tampered accepted", first, second, i)
+				}
+			}
+			if VerifyConsistency(first, second, root(first), root(second), append(proof, root(first))) == nil {
+				t.Errorf("%d -> %d: over-long proof accepted", first, second)
+			}
+			if VerifyConsistency(first, second, root(first), root(second), proof[:len(proof)-1]) == nil {
+				t.Errorf("%d -> %d: truncated proof accepted", first, second)
+			}
+			wrong := root(first)
+			wrong[0] ^= 1
+			if VerifyConsistency(first, second, wrong, root(second), proof) == nil {
+				t.Errorf("%d -> %d: proof accepted for the wrong first root", first, second)
+			}
+			if VerifyConsistency(first, second, root(first), wrong, proof) == nil {
+				t.Errorf("%d -> %d: proof accepted for the wrong second root", first, second)
+			}
+		}
+	}
+	if VerifyConsistency(2, 1, root(2), root(1), nil) == nil {
+		t.Error("shrinking tree accepted")
+	}
+	if VerifyConsistency(3, 3, root(3), root(4), nil) == nil {
+		t.Error("trees of the same size with different roots accepted")
+	}
+}
@@ -0,0 +1,173 @@
+package common
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// SignedTreeHead is a get-sth response as defined in RFC 6962 section 4.3
+type SignedTreeHead struct {
+	TreeSize          uint64 `json:"tree_size"`
+	Timestamp         uint64 `json:"timestamp"`
+	SHA256RootHash    []byte `json:"sha256_root_hash"`
+	TreeHeadSignature []byte `json:"tree_head_signature"`
+}
+
+func (sth *SignedTreeHead) Time() time.Time {
+	return time.Unix(0, int64(sth.Timestamp)*int64(time.Millisecond))
+}
+
+func (sth *SignedTreeHead) Root() ([32]byte, error) {
+	var root [32]byte
+	if len(sth.SHA256RootHash) != 32 {
+		return root, fmt.Errorf("root hash has invalid length %d", len(sth.SHA256RootHash))
+	}
+	copy(root[:], sth.SHA256RootHash)
+	return root, nil
+}
+
+// signedData returns the TreeHeadSignature structure the log signs over
+func (sth *SignedTreeHead) signedData() []byte {
+	data := make([]byte, 18, 18+len(sth.SHA256RootHash))
+	data[0] = 0 // v1
+	data[1] = 1 // tree_hash
+	binary.BigEndian.PutUint64(data[2:], sth.Timestamp)
+	binary.BigEndian.PutUint64(data[10:], sth.TreeSize)
+	return append(data, sth.SHA256RootHash...)
+}
+
+const (
+	hashSHA256 = 4
+	sigRSA     = 1
+	sigECDSA   = 3
+)
+
+func (sth *SignedTreeHead) Verify(key crypto.PublicKey) error {
+	if _, err := sth.Root(); err != nil {
+		return err
+	}
+	sig := sth.TreeHeadSignature
+	if len(sig) < 4 {
+		return fmt.Errorf("tree head signature is truncated")
+	}
+	hashAlg, sigAlg, sigLen := sig[0], sig[1], int(binary.BigEndian.Uint16(sig[2:]))
+	sig = sig[4:]
+	if len(sig) != sigLen {
+		return fmt.Errorf("tree head signature has invalid length")
+	}
+	if hashAlg != hashSHA256 {
+		return fmt.Errorf("unsupported signature hash algorithm %d", hashAlg)
+	}
+	digest := sha256.Sum256(sth.signedData())
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if sigAlg != sigECDSA {
+			return fmt.Errorf("signature algorithm %d doesn't match ECDSA log key", sigAlg)
+		}
+		var ecSig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &ecSig); err != nil || len(rest) != 0 {
+			return fmt.Errorf("malformed ECDSA signature")
+		}
+		if !ecdsa.Verify(k, digest[:], ecSig.R, ecSig.S) {
+			return fmt.Errorf("invalid tree head signature")
+		}
+	case *rsa.PublicKey:
+		if sigAlg != sigRSA {
+			return fmt.Errorf("signature algorithm %d doesn't match RSA log key", sigAlg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("invalid tree head signature")
+		}
+	default:
+		return fmt.Errorf("unsupported log key type %T", key)
+	}
+	return nil
+}
+
+func (sth *SignedTreeHead) Sign(signer crypto.Signer) error {
+	var sigAlg byte
+	switch signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		sigAlg = sigECDSA
+	case *rsa.PublicKey:
+		sigAlg = sigRSA
+	default:
+		return fmt.Errorf("unsupported signing key type %T", signer.Public())
+	}
+	digest := sha256.Sum256(sth.signedData())
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	sth.TreeHeadSignature = make([]byte, 4, 4+len(sig))
+	sth.TreeHeadSignature[0] = hashSHA256
+	sth.TreeHeadSignature[1] = sigAlg
+	binary.BigEndian.PutUint16(sth.TreeHeadSignature[2:], uint16(len(sig)))
+	sth.TreeHeadSignature = append(sth.TreeHeadSignature, sig...)
+	return nil
+}
+
+// Verified STHs are stored one JSON object per line in a file next to the
+// cache file, the last line is the most recent.
+func STHFilename(cacheFilename string) string {
+	return cacheFilename + ".sths"
+}
+
+func LoadSTHs(cacheFilename string) ([]*SignedTreeHead, error) {
+	file, err := os.Open(STHFilename(cacheFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	sths := []*SignedTreeHead{}
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var sth SignedTreeHead
+		if err = json.Unmarshal(s.Bytes(), &sth); err != nil {
+			return nil, fmt.Errorf("malformed STH in %s: %s", STHFilename(cacheFilename), err)
+		}
+		sths = append(sths, &sth)
+	}
+	return sths, s.Err()
+}
+
+func LatestSTH(cacheFilename string) (*SignedTreeHead, error) {
+	sths, err := LoadSTHs(cacheFilename)
+	if err != nil || len(sths) == 0 {
+		return nil, err
+	}
+	return sths[len(sths)-1], nil
+}
+
+func AppendSTH(cacheFilename string, sth *SignedTreeHead) error {
+	data, err := json.Marshal(sth)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(STHFilename(cacheFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestSTHSignature(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, signer := range []crypto.Signer{ecKey, rsaKey} {
+		sth := &SignedTreeHead{
+			TreeSize:       8,
+			Timestamp:      1451606400000,
+			SHA256RootHash: make([]byte, 32),
+		}
+		if err = sth.Sign(signer); err != nil {
+			t.Fatal(err)
+		}
+		if err = sth.Verify(signer.Public()); err != nil {
+			t.Errorf("%T: valid signature rejected: %s", signer, err)
+		}
+
+		tampered := *sth
+		tampered.TreeSize++
+		if tampered.Verify(signer.Public()) == nil {
+			t.Errorf("%T: signature accepted for a different tree size", signer)
+		}
+		tampered = *sth
+		tampered.SHA256RootHash = append([]byte{1}, sth.SHA256RootHash[1:]...)
+		if tampered.Verify(signer.Public()) == nil {
+			t.Errorf("%T: signature accepted for a different root", signer)
+		}
+		tampered = *sth
+		tampered.TreeHeadSignature = append([]byte{}, sth.TreeHeadSignature...)
+		tampered.TreeHeadSignature[len(tampered.TreeHeadSignature)-1] ^= 1
+		if tampered.Verify(signer.Public()) == nil {
+			t.Errorf("%T: corrupted signature accepted", signer)
+		}
+		tampered.TreeHeadSignature = sth.TreeHeadSignature[:len(sth.TreeHeadSignature)-1]
+		if tampered.Verify(signer.Public()) == nil {
+			t.Errorf("%T: truncated signature accepted", signer)
+		}
+		tampered = *sth
+		tampered.SHA256RootHash = sth.SHA256RootHash[:31]
+		if tampered.Verify(signer.Public()) == nil {
+			t.Errorf("%T: short root hash accepted", signer)
+		}
+		if sth.Verify(otherKey.Public()) == nil {
+			t.Errorf("%T: signature accepted for the wrong key", signer)
+		}
+	}
+
+	// a signature made with one key type must not verify against the other
+	sth := &SignedTreeHead{TreeSize: 1, SHA256RootHash: make([]byte, 32)}
+	if err = sth.Sign(ecKey); err != nil {
+		t.Fatal(err)
+	}
+	if sth.Verify(rsaKey.Public()) == nil {
+		t.Error("ECDSA signature accepted for an RSA key")
+	}
+}
@@ -3,8 +3,13 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/rolandshoemaker/ctat/cache"
+	"github.com/rolandshoemaker/ctat/common"
 	"github.com/rolandshoemaker/ctat/downloader"
+	"github.com/rolandshoemaker/ctat/fakelog"
 	"github.com/rolandshoemaker/ctat/filter"
 	"github.com/rolandshoemaker/ctat/graph"
 	"github.com/rolandshoemaker/ctat/stats"
@@ -21,6 +26,20 @@ func main() {
 		cli.BoolFlag{
 			Name: "verbose",
 		},
+		cli.StringFlag{
+			Name:  "asOf",
+			Usage: "reference time for time dependent filters like 'unexpired' (YYYY-MM-DD or RFC 3339), defaults to now",
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if c.GlobalString("asOf") != "" {
+			asOf, err := filter.ParseTime(c.GlobalString("asOf"))
+			if err != nil {
+				return fmt.Errorf("invalid --asOf: %s", err)
+			}
+			filter.SetAsOf(asOf)
+		}
+		return nil
 	}
 	app.Commands = []cli.Command{
 		{
@@ -31,24 +50,321 @@ func main() {
 					Name: "logURI",
 				},
 				cli.StringFlag{
-					Name: "logKey",
+					Name:  "logKey",
+					Usage: "base64 DER or PEM encoded log public key",
 				},
 				cli.StringFlag{
 					Name: "cacheFile",
 				},
+				cli.StringFlag{
+					Name:  "logList",
+					Usage: "log list JSON file, every log in the list is downloaded into --cacheDir",
+				},
+				cli.StringFlag{
+					Name:  "cacheDir",
+					Usage: "directory to keep per-log cache files in when using --logList",
+				},
+				cli.IntFlag{
+					Name:  "workers",
+					Value: 4,
+					Usage: "number of chunks to download concurrently",
+				},
+				cli.IntFlag{
+					Name:  "chunkSize",
+					Value: 10000,
+					Usage: "number of entries in each downloaded chunk",
+				},
+				cli.IntFlag{
+					Name:  "batchSize",
+					Value: 1000,
+					Usage: "number of entries to request with each get-entries call (logs may return smaller batches)",
+				},
+				cli.Float64Flag{
+					Name:  "rateLimit",
+					Usage: "maximum get-entries requests per second to send to each log (0 for no limit)",
+				},
+				cli.IntFlag{
+					Name:  "maxRetries",
+					Value: 10,
+					Usage: "number of times to retry throttled or failed get-entries requests (0 to never retry)",
+				},
+				cli.BoolFlag{
+					Name:  "index",
+					Usage: "keep an index of entry offsets next to the cache file",
+				},
+				cli.BoolFlag{
+					Name:  "tiled",
+					Usage: "the log uses the static CT API, --logURI is its monitoring prefix",
+				},
+				cli.BoolFlag{
+					Name:  "compress",
+					Usage: "create new cache files compressed (existing compressed cache files are always kept compressed)",
+				},
+				cli.BoolFlag{
+					Name:  "follow",
+					Usage: "keep polling the log for new entries instead of exiting once the cache is up to date",
+				},
+				cli.DurationFlag{
+					Name:  "interval",
+					Value: time.Minute,
+					Usage: "how often to poll the log in --follow mode",
+				},
+				cli.StringFlag{
+					Name:  "events",
+					Usage: "file to write a JSON line to for each run of appended entries ('-' for stdout)",
+				},
 			},
 			Action: func(c *cli.Context) {
+				if c.Int("chunkSize") < 1 || c.Int("batchSize") < 1 {
+					fmt.Fprintf(os.Stderr, "--chunkSize and --batchSize must be positive\n")
+					os.Exit(1)
+				}
+				config := downloader.Config{
+					Workers:    c.Int("workers"),
+					ChunkSize:  uint64(c.Int("chunkSize")),
+					BatchSize:  uint64(c.Int("batchSize")),
+					RateLimit:  c.Float64("rateLimit"),
+					MaxRetries: c.Int("maxRetries"),
+					Index:      c.Bool("index"),
+					Tiled:      c.Bool("tiled"),
+					Compress:   c.Bool("compress"),
+				}
+				if c.String("events") == "-" {
+					// keep stdout clean for the event stream
+					config.Output = os.Stderr
+					config.OnAppend = downloader.EventWriter(os.Stdout)
+				} else if c.String("events") != "" {
+					eventsFile, err := os.OpenFile(c.String("events"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to open --events file: %s\n", err)
+						os.Exit(1)
+					}
+					defer eventsFile.Close()
+					config.OnAppend = downloader.EventWriter(eventsFile)
+				}
+				if c.String("logList") != "" {
+					if c.Bool("follow") {
+						fmt.Fprintf(os.Stderr, "--follow can't be used with --logList\n")
+						os.Exit(1)
+					}
+					if c.String("cacheDir") == "" {
+						fmt.Fprintf(os.Stderr, "--cacheDir is required with --logList\n")
+						os.Exit(1)
+					}
+					err := downloader.DownloadList(c.String("logList"), c.String("cacheDir"), config)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "%s\n", err)
+						os.Exit(1)
+					}
+					return
+				}
 				if c.String("logURI") == "" || c.String("logKey") == "" || c.String("cacheFile") == "" {
-					fmt.Fprintf(os.Stderr, "--logURI, --logKey, and --cacheFile are required\n")
+					fmt.Fprintf(os.Stderr, "--logURI, --logKey, and --cacheFile (or --logList and --cacheDir) are required\n")
 					os.Exit(1)
 				}
-				err := downloader.Download(c.String("logURI"), c.String("logKey"), c.String("cacheFile"))
+				logKey, err := downloader.ParseLogKey(c.String("logKey"))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to parse --logKey: %s\n", err)
+					os.Exit(1)
+				}
+				if c.Bool("follow") {
+					err = downloader.Follow(c.String("logURI"), logKey, c.String("cacheFile"), config, c.Duration("interval"))
+				} else {
+					err = downloader.Download(c.String("logURI"), logKey, c.String("cacheFile"), config)
+				}
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "%s\n", err)
 					os.Exit(1)
 				}
 			},
 		},
+		{
+			Name:  "cache",
+			Usage: "Various local cache file tools",
+			Subcommands: []cli.Command{
+				{
+					Name:  "index",
+					Usage: "Build or update the entry offset index for a cache file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile is required\n")
+							os.Exit(1)
+						}
+						idx, err := common.UpdateIndex(c.String("cacheFile"))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to update cache index: %s\n", err)
+							os.Exit(1)
+						}
+						defer idx.Close()
+						fmt.Printf("indexed %d entries\n", idx.Count())
+					},
+				},
+				{
+					Name:  "verify",
+					Usage: "Check the Merkle tree hash of a cache file against the STHs stored by download",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+						cli.StringFlag{
+							Name:  "logURI",
+							Usage: "log to fetch consistency proofs from to find exactly where a cache diverges",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile is required\n")
+							os.Exit(1)
+						}
+						err := cache.Verify(c.String("cacheFile"), c.String("logURI"))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to verify cache file: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+				{
+					Name:  "slice",
+					Usage: "Copy a range of entries from a cache file into a new cache file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+						cli.StringFlag{
+							Name: "output",
+						},
+						cli.IntFlag{
+							Name:  "from",
+							Usage: "index of the first entry to copy",
+						},
+						cli.IntFlag{
+							Name:  "to",
+							Usage: "index after the last entry to copy",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" || c.String("output") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile and --output are required\n")
+							os.Exit(1)
+						}
+						if c.Int("from") < 0 || c.Int("to") < 0 {
+							fmt.Fprintf(os.Stderr, "--from and --to must not be negative\n")
+							os.Exit(1)
+						}
+						err := cache.Slice(c.String("cacheFile"), c.String("output"), uint64(c.Int("from")), uint64(c.Int("to")))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to slice cache file: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+				{
+					Name:  "merge",
+					Usage: "Merge the cache files passed as arguments into a new cache file, dropping duplicate entries",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "output",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("output") == "" || len(c.Args()) == 0 {
+							fmt.Fprintf(os.Stderr, "--output and at least one cache file are required\n")
+							os.Exit(1)
+						}
+						err := cache.Merge(c.String("output"), c.Args())
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to merge cache files: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+				{
+					Name:  "convert",
+					Usage: "Convert entries between cache files, JSONL files, and directories of PEM files",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "input",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "file to write, or directory for --to pem",
+						},
+						cli.StringFlag{
+							Name:  "from",
+							Value: "cache",
+							Usage: "input format (cache, jsonl, pem)",
+						},
+						cli.StringFlag{
+							Name:  "to",
+							Value: "jsonl",
+							Usage: "output format (cache, jsonl, pem)",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("input") == "" || c.String("output") == "" {
+							fmt.Fprintf(os.Stderr, "--input and --output are required\n")
+							os.Exit(1)
+						}
+						err := cache.Convert(c.String("input"), c.String("output"), c.String("from"), c.String("to"))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to convert entries: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+				{
+					Name:  "compress",
+					Usage: "Write a compressed copy of a cache file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+						cli.StringFlag{
+							Name: "output",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" || c.String("output") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile and --output are required\n")
+							os.Exit(1)
+						}
+						err := cache.Compress(c.String("cacheFile"), c.String("output"))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to compress cache file: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+				{
+					Name:  "decompress",
+					Usage: "Write an uncompressed copy of a compressed cache file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+						cli.StringFlag{
+							Name: "output",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" || c.String("output") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile and --output are required\n")
+							os.Exit(1)
+						}
+						err := cache.Decompress(c.String("cacheFile"), c.String("output"))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to decompress cache file: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+			},
+		},
 		{
 			Name:  "ca-graph",
 			Usage: "Various CA graph tools",
@@ -70,7 +386,12 @@ func main() {
 							Name: "rootsURI",
 						},
 						cli.StringFlag{
-							Name: "filters",
+							Name:  "filters",
+							Usage: "filter expression, e.g. 'leafOnly and not issuerCN(\"X\")', a comma separated list must all match",
+						},
+						cli.BoolFlag{
+							Name:  "includePrecerts",
+							Usage: "also build the graph from precertificate entries",
 						},
 					},
 					Action: func(c *cli.Context) {
@@ -78,7 +399,7 @@ func main() {
 							fmt.Fprintf(os.Stderr, "--cacheFile and --graphFile are required\n")
 							os.Exit(1)
 						}
-						err := graph.Build(c.String("rootsFile"), c.String("rootsURI"), c.String("cacheFile"), c.String("graphFile"), c.String("filters"), c.GlobalBool("verbose"))
+						err := graph.Build(c.String("rootsFile"), c.String("rootsURI"), c.String("cacheFile"), c.String("graphFile"), c.String("filters"), c.GlobalBool("verbose"), c.Bool("includePrecerts"))
 						if err != nil {
 							fmt.Fprintf(os.Stderr, "Failed to build CA graph: %s\n", err)
 							os.Exit(1)
@@ -137,12 +458,55 @@ func main() {
 		},
 		{
 			Name: "analyse",
+			Subcommands: []cli.Command{
+				{
+					Name:  "merge",
+					Usage: "Combine the states written by 'analyse --format state' for separate caches into one report",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cutoffs",
+						},
+						cli.StringFlag{
+							Name:  "format",
+							Value: "text",
+							Usage: "output format, text, json, csv or state",
+						},
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "file to write results to, defaults to stdout",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if len(c.Args()) == 0 {
+							fmt.Fprintf(os.Stderr, "at least one state file is required\n")
+							os.Exit(1)
+						}
+						if c.String("cutoffs") != "" {
+							err := stats.StringToCutoffs(c.String("cutoffs"))
+							if err != nil {
+								fmt.Fprintf(os.Stderr, "Failed to parse --cutoffs: %s\n", err)
+								os.Exit(1)
+							}
+						}
+						output := analysisOutput(c)
+						err := stats.MergeStates(c.Args(), c.String("format"), output)
+						if cErr := closeOutput(output); err == nil && cErr != nil {
+							err = fmt.Errorf("failed to write --output file: %s", cErr)
+						}
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to merge analysis states: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+			},
 			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name: "cacheFile",
 				},
 				cli.StringFlag{
-					Name: "filters",
+					Name:  "filters",
+					Usage: "filter expression, e.g. 'leafOnly and not issuerCN(\"X\")', a comma separated list must all match",
 				},
 				cli.StringFlag{
 					Name: "leafMetrics",
@@ -162,13 +526,56 @@ func main() {
 				cli.BoolFlag{
 					Name: "showProgress",
 				},
+				cli.BoolFlag{
+					Name:  "includePrecerts",
+					Usage: "also analyse precertificate entries",
+				},
+				cli.StringFlag{
+					Name:  "groupBy",
+					Usage: "run each metric separately per issuer, issuerOrg, keyType, sigAlg, or etld1",
+				},
+				cli.StringFlag{
+					Name:  "timeBucket",
+					Usage: "split each metric into a series by month, week, or day",
+				},
+				cli.StringFlag{
+					Name:  "timeSource",
+					Value: "notBefore",
+					Usage: "time to bucket by with --timeBucket, the certificate notBefore or when it was logged",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format, text, json, csv or state (for 'analyse merge', nameMetrics and keyReuseMetrics state holds every name and key hash so is large for whole logs)",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "file to write results to, defaults to stdout",
+				},
 			},
 			Action: func(c *cli.Context) {
 				if c.String("leafMetrics") == "" || c.String("cacheFile") == "" {
 					fmt.Fprintf(os.Stderr, "--cacheFile and --leafMetrics are required\n")
 					os.Exit(1)
 				}
-				metrics, err := stats.StringToMetrics(c.String("leafMetrics"))
+				var splits []string
+				if c.String("groupBy") != "" {
+					split, err := stats.GroupSplit(c.String("groupBy"))
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Invalid --groupBy: %s\n", err)
+						os.Exit(1)
+					}
+					splits = append(splits, split)
+				}
+				if c.String("timeBucket") != "" {
+					split, err := stats.TimeSplit(c.String("timeSource"), c.String("timeBucket"))
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Invalid --timeBucket: %s\n", err)
+						os.Exit(1)
+					}
+					splits = append(splits, split)
+				}
+				metrics, err := stats.StringToMetrics(c.String("leafMetrics"), splits)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Failed to parse --leafMetrics: %s\n", err)
 					os.Exit(1)
@@ -180,24 +587,77 @@ func main() {
 						os.Exit(1)
 					}
 				}
-				var filters []filter.Filter
+				var filters []filter.EntryFilter
+				var filterNames []string
 				if c.String("filters") != "" {
-					filters, err = filter.StringToFilters(c.String("filters"))
+					filters, filterNames, err = filter.StringToNamedFilters(c.String("filters"))
 					if err != nil {
 						fmt.Fprintf(os.Stderr, "Failed to parse --filters: %s\n", err)
 						os.Exit(1)
 					}
 				}
 				if c.String("issuerFilter") != "" {
-					filters = append(filters, filter.IssuerCNFilter(c.String("issuerFilter")))
+					filters = append(filters, filter.Entry(filter.IssuerCNFilter(c.String("issuerFilter"))))
+					filterNames = append(filterNames, "--issuerFilter")
+				}
+				output := analysisOutput(c)
+				err = stats.Analyse(c.String("cacheFile"), filters, filterNames, metrics, c.Bool("measureErrors"), c.Int("mapWorkers"), c.Bool("showProgress"), c.Bool("includePrecerts"), c.String("format"), output)
+				if cErr := closeOutput(output); err == nil && cErr != nil {
+					err = fmt.Errorf("failed to write --output file: %s", cErr)
 				}
-				err = stats.Analyse(c.String("cacheFile"), filters, metrics, c.Bool("measureErrors"), c.Int("mapWorkers"), c.Bool("showProgress"))
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse cache file: %s\n", err)
+					fmt.Fprintf(os.Stderr, "Failed to analyse cache file: %s\n", err)
 					os.Exit(1)
 				}
 			},
 		},
+		{
+			Name:  "fakelog",
+			Usage: "Serve a local cache file as a CT log",
+			Subcommands: []cli.Command{
+				{
+					Name:  "serve",
+					Usage: "Serve get-sth, get-entries, get-roots, and get-sth-consistency from a cache file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name: "cacheFile",
+						},
+						cli.StringFlag{
+							Name:  "keyFile",
+							Usage: "PEM ECDSA key to sign STHs with, generated if it doesn't exist",
+						},
+						cli.StringFlag{
+							Name:  "listen",
+							Value: "localhost:6962",
+						},
+						cli.IntFlag{
+							Name:  "treeSize",
+							Usage: "only serve the first N entries of the cache",
+						},
+						cli.IntFlag{
+							Name:  "maxBatch",
+							Value: 1000,
+							Usage: "maximum number of entries returned by get-entries",
+						},
+					},
+					Action: func(c *cli.Context) {
+						if c.String("cacheFile") == "" {
+							fmt.Fprintf(os.Stderr, "--cacheFile is required\n")
+							os.Exit(1)
+						}
+						if c.Int("treeSize") < 0 || c.Int("maxBatch") < 0 {
+							fmt.Fprintf(os.Stderr, "--treeSize and --maxBatch can't be negative\n")
+							os.Exit(1)
+						}
+						err := fakelog.Serve(c.String("cacheFile"), c.String("keyFile"), c.String("listen"), uint64(c.Int("treeSize")), uint64(c.Int("maxBatch")))
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Failed to serve cache file: %s\n", err)
+							os.Exit(1)
+						}
+					},
+				},
+			},
+		},
 		{
 			Name:  "scanner",
 			Usage: "Host extracter + TLS scanner (generates adoption/failure stats for HTTPS deployment)",
@@ -209,3 +669,28 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// analysisOutput checks --format and opens --output, or stdout if it isn't set
+func analysisOutput(c *cli.Context) *os.File {
+	if !stats.ValidFormat(c.String("format")) {
+		fmt.Fprintf(os.Stderr, "--format must be one of %s\n", strings.Join(stats.Formats, ", "))
+		os.Exit(1)
+	}
+	if c.String("output") == "" {
+		return os.Stdout
+	}
+	output, err := os.Create(c.String("output"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create --output file: %s\n", err)
+		os.Exit(1)
+	}
+	return output
+}
+
+// closeOutput closes a file opened by analysisOutput, stdout is left open
+func closeOutput(output *os.File) error {
+	if output == os.Stdout {
+		return nil
+	}
+	return output.Close()
+}
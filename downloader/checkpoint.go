@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// checkpoint records how many entries have been written to a cache file and
+// the size of the file once they had been, chunks are only ever appended after
+// the checkpoint has been read so anything past Offset is a partial write.
+type checkpoint struct {
+	Entries uint64
+	Offset  int64
+}
+
+func checkpointFilename(cacheFilename string) string {
+	return cacheFilename + ".checkpoint"
+}
+
+func loadCheckpoint(cacheFilename string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointFilename(cacheFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cp checkpoint
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checkpoint file: %s", err)
+	}
+	return &cp, nil
+}
+
+func (cp *checkpoint) save(cacheFilename string) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a half written checkpoint
+	tmpFilename := checkpointFilename(cacheFilename) + ".tmp"
+	err = ioutil.WriteFile(tmpFilename, data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, checkpointFilename(cacheFilename))
+}
@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"bytes"
+	"sync"
+)
+
+type chunk struct {
+	start uint64
+	end   uint64
+	data  []byte
+	// offset in data of the end of each entry
+	ends []int64
+	err  error
+}
+
+type rangeFetcher struct {
+	client    logClient
+	workers   int
+	chunkSize uint64
+}
+
+func (rf *rangeFetcher) fetchChunk(c *chunk) {
+	buf := new(bytes.Buffer)
+	c.ends, c.err = rf.client.fetch(buf, c.start, c.end)
+	c.data = buf.Bytes()
+}
+
+// fetchRange splits [start, end) into chunks which are fetched concurrently
+// and passed to write in log order. At most two chunks per worker are held in
+// memory at once so a single slow chunk can't cause the rest of the range to
+// pile up behind it.
+func (rf *rangeFetcher) fetchRange(start, end uint64, write func(*chunk) error) error {
+	jobs := make(chan *chunk)
+	results := make(chan *chunk)
+	window := make(chan struct{}, rf.workers*2)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(jobs)
+		for s := start; s < end; s += rf.chunkSize {
+			e := s + rf.chunkSize
+			if e > end {
+				e = end
+			}
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case jobs <- &chunk{start: s, end: e}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < rf.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				rf.fetchChunk(c)
+				results <- c
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[uint64]*chunk)
+	next := start
+	var err error
+	for c := range results {
+		if err != nil {
+			// drain whatever the workers were already fetching
+			continue
+		}
+		if c.err != nil {
+			err = c.err
+			close(stop)
+			continue
+		}
+		pending[c.start] = c
+		for {
+			nc, present := pending[next]
+			if !present {
+				break
+			}
+			delete(pending, next)
+			if err = write(nc); err != nil {
+				close(stop)
+				break
+			}
+			next = nc.end
+			<-window
+		}
+	}
+	return err
+}
@@ -0,0 +1,277 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rolandshoemaker/ctat/common"
+)
+
+var (
+	defaultBatchSize  = uint64(1000)
+	defaultMaxRetries = 10
+	baseBackoff       = time.Second
+	maxBackoff        = 2 * time.Minute
+	requestTimeout    = time.Minute
+)
+
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+func (rl *rateLimiter) wait() {
+	if rl == nil {
+		return
+	}
+	rl.mu.Lock()
+	now := time.Now()
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+	until := rl.next
+	rl.next = rl.next.Add(rl.interval)
+	rl.mu.Unlock()
+	time.Sleep(until.Sub(now))
+}
+
+// backoff returns a jittered exponential delay for the given attempt, somewhere
+// between half and all of base * 2^attempt
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << uint(attempt)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (re *retryableError) Error() string {
+	return re.err.Error()
+}
+
+// statusError is a non-retryable error response from a log
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (se *statusError) Error() string {
+	return se.msg
+}
+
+type encodedEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+// logFetcher makes rate limited requests to a log, retrying with backoff when
+// the log is throttling or failing
+type logFetcher struct {
+	client     *http.Client
+	limiter    *rateLimiter
+	maxRetries int
+
+	retried int64
+}
+
+func newLogFetcher(config Config) *logFetcher {
+	lf := &logFetcher{
+		client:     &http.Client{Timeout: requestTimeout},
+		limiter:    newRateLimiter(config.RateLimit),
+		maxRetries: config.MaxRetries,
+	}
+	if lf.maxRetries < 0 {
+		lf.maxRetries = defaultMaxRetries
+	}
+	return lf
+}
+
+func (lf *logFetcher) retries() *int64 {
+	return &lf.retried
+}
+
+// get makes a single request, failures that may go away if the request is
+// retried are returned as a *retryableError
+func (lf *logFetcher) get(uri string) ([]byte, error) {
+	lf.limiter.wait()
+	resp, err := lf.client.Get(uri)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &retryableError{err: err}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		re := &retryableError{err: fmt.Errorf("log returned status code %d", resp.StatusCode)}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			re.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, re
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode, fmt.Sprintf("log returned status code %d: %s", resp.StatusCode, bytes.TrimSpace(body))}
+	}
+	return body, nil
+}
+
+// retry runs f until it succeeds, returns an error that isn't a
+// *retryableError, or has been retried maxRetries times
+func (lf *logFetcher) retry(f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		re, ok := err.(*retryableError)
+		if !ok || attempt >= lf.maxRetries {
+			return err
+		}
+		atomic.AddInt64(&lf.retried, 1)
+		wait := backoff(attempt)
+		if re.retryAfter > wait {
+			wait = re.retryAfter
+		}
+		time.Sleep(wait)
+	}
+}
+
+// logClient is what update needs from a log, implemented by entriesClient
+// for RFC 6962 logs and tileClient for static CT API logs
+type logClient interface {
+	getSTH() (*common.SignedTreeHead, error)
+	getConsistencyProof(first, second uint64) ([][32]byte, error)
+	// fetch writes the entries [start, end) to buf and returns the offset in
+	// buf of the end of each one
+	fetch(buf *bytes.Buffer, start, end uint64) ([]int64, error)
+	retries() *int64
+}
+
+func newLogClient(logURI string, logKey []byte, config Config) logClient {
+	if config.Tiled {
+		return newTileClient(logURI, logKey, config)
+	}
+	return newEntriesClient(logURI, config)
+}
+
+// entriesClient fetches entries from a log using get-entries, it learns the
+// largest batch the log will return from short responses
+type entriesClient struct {
+	*logFetcher
+	logURI    string
+	batchSize uint64
+
+	// largest batch the log has returned when asked for more, logs like
+	// Trillian also cut batches short at page boundaries so the smallest
+	// short batch says nothing about the log's limit
+	maxBatch uint64
+}
+
+func newEntriesClient(logURI string, config Config) *entriesClient {
+	ec := &entriesClient{
+		logFetcher: newLogFetcher(config),
+		logURI:     logURI,
+		batchSize:  config.BatchSize,
+	}
+	if ec.batchSize == 0 {
+		ec.batchSize = defaultBatchSize
+	}
+	return ec
+}
+
+func (ec *entriesClient) getSTH() (*common.SignedTreeHead, error) {
+	return getSTH(ec.logURI)
+}
+
+func (ec *entriesClient) getConsistencyProof(first, second uint64) ([][32]byte, error) {
+	return GetConsistencyProof(ec.logURI, first, second)
+}
+
+func (ec *entriesClient) request(start, end uint64) ([]encodedEntry, error) {
+	body, err := ec.get(fmt.Sprintf("%s/ct/v1/get-entries?start=%d&end=%d", ec.logURI, start, end))
+	if err != nil {
+		return nil, err
+	}
+	var entries struct {
+		Entries []encodedEntry `json:"entries"`
+	}
+	err = json.Unmarshal(body, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse get-entries response: %s", err)
+	}
+	if len(entries.Entries) == 0 {
+		return nil, &retryableError{err: fmt.Errorf("log returned no entries for %d-%d", start, end)}
+	}
+	if uint64(len(entries.Entries)) > end-start+1 {
+		return nil, fmt.Errorf("log returned %d entries for %d-%d", len(entries.Entries), start, end)
+	}
+	return entries.Entries, nil
+}
+
+func (ec *entriesClient) getEntries(start, end uint64) ([]encodedEntry, error) {
+	var entries []encodedEntry
+	err := ec.retry(func() error {
+		var err error
+		entries, err = ec.request(start, end)
+		return err
+	})
+	return entries, err
+}
+
+func (ec *entriesClient) learnBatchSize(size uint64) {
+	for {
+		current := atomic.LoadUint64(&ec.maxBatch)
+		if size <= current || atomic.CompareAndSwapUint64(&ec.maxBatch, current, size) {
+			return
+		}
+	}
+}
+
+func (ec *entriesClient) fetch(buf *bytes.Buffer, start, end uint64) ([]int64, error) {
+	ends := []int64{}
+	for start < end {
+		batchEnd := start + ec.batchSize
+		if batchEnd > end {
+			batchEnd = end
+		}
+		entries, err := ec.getEntries(start, batchEnd-1)
+		if err != nil {
+			return nil, err
+		}
+		if n := uint64(len(entries)); n < batchEnd-start {
+			// the log caps the batch size below what we asked for, keep
+			// asking for the full batch so the cap can't drift down
+			ec.learnBatchSize(n)
+		}
+		for _, e := range entries {
+			if err = common.WriteEntry(buf, e.LeafInput, e.ExtraData); err != nil {
+				return nil, err
+			}
+			ends = append(ends, int64(buf.Len()))
+		}
+		start += uint64(len(entries))
+	}
+	return ends, nil
+}
@@ -1,68 +1,275 @@
 package downloader
 
 import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/rolandshoemaker/ctat/common"
+
 	ct "github.com/rolandshoemaker/certificatetransparency"
 )
 
-func Download(logURL, logKey, cacheFilename string) error {
-	pemPublicKey := fmt.Sprintf(`-----BEGIN PUBLIC KEY-----
-%s
------END PUBLIC KEY-----`, logKey)
-	ctLog, err := ct.NewLog(logURL, pemPublicKey)
+var defaultChunkSize = uint64(10000)
+
+type Config struct {
+	// number of chunks to fetch concurrently
+	Workers int
+	// number of entries in each chunk
+	ChunkSize uint64
+	// number of entries to request with each get-entries call, logs may
+	// return smaller batches
+	BatchSize uint64
+	// maximum get-entries requests per second, 0 for no limit
+	RateLimit float64
+	// number of times a failed get-entries request is retried, negative for
+	// the default of 10
+	MaxRetries int
+	// keep an index of entry offsets alongside the cache file
+	Index bool
+	// the log uses the static CT API, the log URL is its monitoring prefix
+	Tiled bool
+	// create new cache files compressed, existing compressed cache files are
+	// always appended to compressed
+	Compress bool
+	// where status and progress messages are written, defaults to stdout
+	Output io.Writer
+	// called each time entries are appended to a cache file
+	OnAppend func(AppendEvent)
+}
+
+func (c Config) out() io.Writer {
+	if c.Output == nil {
+		return os.Stdout
+	}
+	return c.Output
+}
+
+// AppendEvent describes a run of entries appended to a cache file, Offset and
+// Length are the position of the new entries in the file. For compressed cache
+// files they are the position of the gzip member holding the new entries.
+type AppendEvent struct {
+	Log        string
+	CacheFile  string
+	FirstIndex uint64
+	LastIndex  uint64
+	Offset     int64
+	Length     int64
+}
+
+// ParseLogKey accepts either a PEM encoded public key or the bare base64 DER
+// used in log lists
+func ParseLogKey(logKey string) ([]byte, error) {
+	logKey = strings.TrimSpace(logKey)
+	if strings.HasPrefix(logKey, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(logKey))
+		if block == nil {
+			return nil, fmt.Errorf("malformed PEM public key")
+		}
+		return block.Bytes, nil
+	}
+	return base64.StdEncoding.DecodeString(logKey)
+}
+
+func printProgress(out io.Writer, written, retries *int64, total uint64, stop chan struct{}) {
+	started := time.Now()
+	for {
+		select {
+		case <-stop:
+			fmt.Fprintln(out, "")
+			return
+		default:
+			current := atomic.LoadInt64(written)
+			eps := float64(current) / time.Since(started).Seconds()
+			remaining := int64(total) - current
+			fmt.Fprintf(out, "\x1b[80D\x1b[2K")
+			fmt.Fprintf(
+				out,
+				"%.2f%% (%d remaining, %d retries, eta: %s)",
+				(float64(current)/float64(total))*100.0,
+				remaining,
+				atomic.LoadInt64(retries),
+				time.Second*time.Duration(float64(remaining)/eps),
+			)
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+}
+
+func Download(logURL string, logKey []byte, cacheFilename string, config Config) error {
+	_, _, err := update(logURL, logKey, cacheFilename, config)
+	return err
+}
+
+// update brings the cache file up to date with the log and returns the number
+// of entries in the cache and in the log
+func update(logURL string, logKey []byte, cacheFilename string, config Config) (uint64, uint64, error) {
+	out := config.out()
+	publicKey, err := x509.ParsePKIXPublicKey(logKey)
 	if err != nil {
-		return fmt.Errorf("Failed to create CT log client: %s", err)
+		return 0, 0, fmt.Errorf("Failed to parse log key: %s", err)
 	}
 
 	file, err := os.OpenFile(cacheFilename, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
-		return fmt.Errorf("Failed to create/read cache file: %s\n", err)
+		return 0, 0, fmt.Errorf("Failed to create/read cache file: %s\n", err)
 	}
 	defer file.Close()
 
 	entriesFile := ct.EntriesFile{File: file}
+	compressed, err := common.IsCompressed(cacheFilename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to read cache file: %s\n", err)
+	}
+	if config.Compress && !compressed {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to stat cache file: %s\n", err)
+		}
+		if info.Size() > 0 {
+			return 0, 0, fmt.Errorf("Cache file already exists and isn't compressed, use 'cache compress' to convert it\n")
+		}
+		compressed = true
+	}
+	if compressed && config.Index {
+		return 0, 0, fmt.Errorf("Compressed cache files can't be indexed\n")
+	}
 
-	sth, err := ctLog.GetSignedTreeHead()
+	client := newLogClient(logURL, logKey, config)
+	sth, err := updateSTH(client, publicKey, cacheFilename)
 	if err != nil {
-		return fmt.Errorf("Failed to get log STH %s\n", err)
+		if _, ok := err.(*inconsistentError); ok {
+			return 0, 0, &inconsistentError{fmt.Sprintf("Refusing to update cache: %s\n", err)}
+		}
+		return 0, 0, fmt.Errorf("Failed to update log STH: %s\n", err)
 	}
 
-	fmt.Println("counting entries in local cache...")
-	count, err := entriesFile.Count()
+	cp, err := loadCheckpoint(cacheFilename)
 	if err != nil {
-		return fmt.Errorf("Failed to count entries in cache file: %s\n", err)
+		return 0, 0, fmt.Errorf("Failed to read cache checkpoint: %s\n", err)
 	}
-	fmt.Printf("local entries: %d, remote entries: %d at %s\n", count, sth.Size, sth.Time.Format(time.ANSIC))
-	if count < sth.Size {
-		fmt.Println("updating local cache...")
-		statusChan := make(chan ct.OperationStatus)
-		go func() {
-			status, ok := <-statusChan
-			if !ok {
-				return
+	if cp == nil {
+		fmt.Fprintln(out, "counting entries in local cache...")
+		count, err := common.CountEntries(&entriesFile, cacheFilename)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to count entries in cache file: %s\n", err)
+		}
+		offset, err := file.Seek(0, 2)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to seek to end of cache file: %s\n", err)
+		}
+		cp = &checkpoint{Entries: count, Offset: offset}
+		if err = cp.save(cacheFilename); err != nil {
+			return 0, 0, fmt.Errorf("Failed to save cache checkpoint: %s\n", err)
+		}
+	} else {
+		info, err := file.Stat()
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to stat cache file: %s\n", err)
+		}
+		if info.Size() < cp.Offset {
+			return 0, 0, fmt.Errorf("Cache file is shorter than its checkpoint (%d < %d bytes)\n", info.Size(), cp.Offset)
+		}
+		// anything past the checkpoint is a partially written chunk
+		if err = file.Truncate(cp.Offset); err != nil {
+			return 0, 0, fmt.Errorf("Failed to truncate cache file to checkpoint: %s\n", err)
+		}
+	}
+	if _, err = file.Seek(cp.Offset, 0); err != nil {
+		return 0, 0, fmt.Errorf("Failed to seek to cache checkpoint: %s\n", err)
+	}
+	var idx *common.Index
+	if config.Index {
+		fmt.Fprintln(out, "updating cache index...")
+		idx, err = common.UpdateIndex(cacheFilename)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Failed to update cache index: %s\n", err)
+		}
+		defer idx.Close()
+		if idx.Count() != cp.Entries {
+			return 0, 0, fmt.Errorf("Cache index has %d entries but checkpoint has %d\n", idx.Count(), cp.Entries)
+		}
+	}
+
+	fmt.Fprintf(out, "local entries: %d, remote entries: %d at %s\n", cp.Entries, sth.TreeSize, sth.Time().Format(time.ANSIC))
+	if cp.Entries < sth.TreeSize {
+		fmt.Fprintln(out, "updating local cache...")
+		rf := rangeFetcher{client: client, workers: config.Workers, chunkSize: config.ChunkSize}
+		if rf.workers < 1 {
+			rf.workers = 1
+		}
+		if rf.chunkSize == 0 {
+			rf.chunkSize = defaultChunkSize
+		}
+		if config.Tiled && rf.chunkSize%tileWidth != 0 {
+			// chunks that split a tile would fetch it twice
+			rf.chunkSize += tileWidth - rf.chunkSize%tileWidth
+		}
+		written := int64(0)
+		stopProg := make(chan struct{})
+		go printProgress(out, &written, client.retries(), sth.TreeSize-cp.Entries, stopProg)
+		err = rf.fetchRange(cp.Entries, sth.TreeSize, func(c *chunk) error {
+			data := c.data
+			if compressed {
+				// each chunk is its own gzip member so a partially written
+				// one can be truncated away like an uncompressed chunk
+				var err error
+				if data, err = common.CompressEntries(c.data); err != nil {
+					return err
+				}
+			}
+			if _, err := file.Write(data); err != nil {
+				return err
+			}
+			if err := file.Sync(); err != nil {
+				return err
 			}
-			started := time.Now()
-			startCount := count
-			for {
-				status, ok = <-statusChan
-				if !ok {
-					return
+			if idx != nil {
+				ends := make([]int64, len(c.ends))
+				for i, e := range c.ends {
+					ends[i] = cp.Offset + e
 				}
-				fmt.Printf("\x1b[80D\x1b[2K")
-				eps := float64(status.Current-startCount) / time.Since(started).Seconds()
-				remaining := status.Length - status.Current
-				fmt.Printf("%.2f%% (%d remaining, eta: %s)", status.Percentage(), remaining, time.Second*time.Duration(float64(remaining)/eps))
-				time.Sleep(250 * time.Millisecond)
+				if err := idx.Append(ends); err != nil {
+					return err
+				}
+			}
+			event := AppendEvent{
+				Log:        logURL,
+				CacheFile:  cacheFilename,
+				FirstIndex: c.start,
+				LastIndex:  c.end - 1,
+				Offset:     cp.Offset,
+				Length:     int64(len(data)),
+			}
+			cp.Entries = c.end
+			cp.Offset += int64(len(data))
+			atomic.AddInt64(&written, int64(c.end-c.start))
+			if err := cp.save(cacheFilename); err != nil {
+				return err
 			}
-		}()
-		_, err = ctLog.DownloadRange(file, statusChan, count, sth.Size)
+			if config.OnAppend != nil {
+				config.OnAppend(event)
+			}
+			return nil
+		})
+		stopProg <- struct{}{}
+		if retries := atomic.LoadInt64(client.retries()); retries > 0 {
+			if ec, ok := client.(*entriesClient); ok {
+				fmt.Fprintf(out, "%d get-entries requests were retried, largest short batch %d\n", retries, atomic.LoadUint64(&ec.maxBatch))
+			} else {
+				fmt.Fprintf(out, "%d tile requests were retried\n", retries)
+			}
+		}
 		if err != nil {
-			return fmt.Errorf("Failed to downlad new log entries: %s\n", err)
+			return cp.Entries, sth.TreeSize, fmt.Errorf("Failed to downlad new log entries: %s\n", err)
 		}
 	}
 
-	return nil
+	return cp.Entries, sth.TreeSize, nil
 }
@@ -0,0 +1,40 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Follow keeps a cache file up to date by polling the log for a new STH every
+// interval. Errors fetching from the log are reported and retried at the next
+// poll, a log that fails verification stops following.
+func Follow(logURL string, logKey []byte, cacheFilename string, config Config, interval time.Duration) error {
+	for {
+		_, _, err := update(logURL, logKey, cacheFilename, config)
+		if err != nil {
+			if _, ok := err.(*inconsistentError); ok {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "%s", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// EventWriter returns an OnAppend callback that writes each event to w as a
+// line of JSON
+func EventWriter(w io.Writer) func(AppendEvent) {
+	mu := new(sync.Mutex)
+	encoder := json.NewEncoder(w)
+	return func(e AppendEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := encoder.Encode(e); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write append event: %s\n", err)
+		}
+	}
+}
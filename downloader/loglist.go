@@ -0,0 +1,163 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rolandshoemaker/ctat/common"
+)
+
+type listedLog struct {
+	Description   string `json:"description"`
+	LogID         []byte `json:"log_id"`
+	Key           []byte `json:"key"`
+	URL           string `json:"url"`
+	MonitoringURL string `json:"monitoring_url"`
+
+	tiled bool
+}
+
+// logList covers both the original Chrome log list format, which has a
+// top level list of logs, and the current format where each operator has
+// its own lists of RFC 6962 and static CT API logs
+type logList struct {
+	Logs      []listedLog `json:"logs"`
+	Operators []struct {
+		Logs      []listedLog `json:"logs"`
+		TiledLogs []listedLog `json:"tiled_logs"`
+	} `json:"operators"`
+}
+
+func loadLogList(filename string) ([]listedLog, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var list logList
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	logs := list.Logs
+	for _, o := range list.Operators {
+		logs = append(logs, o.Logs...)
+		for _, l := range o.TiledLogs {
+			l.URL = l.MonitoringURL
+			l.tiled = true
+			logs = append(logs, l)
+		}
+	}
+	for i := range logs {
+		l := &logs[i]
+		if len(l.Key) == 0 || l.URL == "" {
+			return nil, fmt.Errorf("log '%s' is missing a key or URL", l.Description)
+		}
+		// older lists don't include log IDs or URL schemes
+		if len(l.LogID) == 0 {
+			id := sha256.Sum256(l.Key)
+			l.LogID = id[:]
+		}
+		if !strings.Contains(l.URL, "://") {
+			l.URL = "https://" + l.URL
+		}
+		l.URL = strings.TrimRight(l.URL, "/")
+	}
+	return logs, nil
+}
+
+func (l listedLog) cacheFilename(cacheDir string) string {
+	return filepath.Join(cacheDir, base64.URLEncoding.EncodeToString(l.LogID))
+}
+
+type listResult struct {
+	log    listedLog
+	local  uint64
+	remote uint64
+	err    error
+}
+
+// localEntries counts the entries in a cache file without updating it, for
+// logs that failed to update
+func localEntries(cacheFilename string) (uint64, error) {
+	if _, err := os.Stat(cacheFilename); os.IsNotExist(err) {
+		return 0, nil
+	}
+	cp, err := loadCheckpoint(cacheFilename)
+	if err != nil {
+		return 0, err
+	}
+	if cp != nil {
+		// anything past the checkpoint is a partially written chunk
+		return cp.Entries, nil
+	}
+	entries, err := common.LoadCacheFile(cacheFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer entries.Close()
+	return common.CountEntries(entries.EntriesFile, cacheFilename)
+}
+
+// DownloadList updates a cache file for every log in a Chrome style log list,
+// cache files are kept in cacheDir and named using the URL safe base64 log ID
+func DownloadList(logListFilename, cacheDir string, config Config) error {
+	logs, err := loadLogList(logListFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to load log list: %s\n", err)
+	}
+	err = os.MkdirAll(cacheDir, 0777)
+	if err != nil {
+		return fmt.Errorf("Failed to create cache directory: %s\n", err)
+	}
+
+	out := config.out()
+	results := []listResult{}
+	failed := 0
+	for _, l := range logs {
+		fmt.Fprintf(out, "# %s (%s)\n", l.Description, l.URL)
+		r := listResult{log: l}
+		logConfig := config
+		logConfig.Tiled = l.tiled
+		r.local, r.remote, r.err = update(l.URL, l.Key, l.cacheFilename(cacheDir), logConfig)
+		if r.err != nil {
+			fmt.Fprintf(os.Stderr, "%s", r.err)
+			failed++
+		}
+		results = append(results, r)
+		fmt.Fprintln(out, "")
+	}
+
+	w := new(tabwriter.Writer)
+	w.Init(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Log\tLog ID\tLocal entries\tRemote entries\tStatus\n")
+	fmt.Fprintf(w, "---\t------\t-------------\t--------------\t------\n")
+	for _, r := range results {
+		status := "up to date"
+		local, remote := fmt.Sprintf("%d", r.local), fmt.Sprintf("%d", r.remote)
+		if r.err != nil {
+			status = fmt.Sprintf("failed: %s", strings.TrimSpace(r.err.Error()))
+			remote = "?"
+			if count, err := localEntries(r.log.cacheFilename(cacheDir)); err == nil {
+				local = fmt.Sprintf("%d", count)
+			} else {
+				local = "?"
+			}
+		} else if r.local < r.remote {
+			status = fmt.Sprintf("%d behind", r.remote-r.local)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.log.Description, base64.StdEncoding.EncodeToString(r.log.LogID), local, remote, status)
+	}
+	w.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to update %d of %d logs\n", failed, len(logs))
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rolandshoemaker/ctat/common"
+)
+
+// inconsistentError is returned when a log presents an STH that is badly
+// signed or that isn't consistent with what was previously stored, retrying
+// won't fix either
+type inconsistentError struct {
+	msg string
+}
+
+func (ie *inconsistentError) Error() string {
+	return ie.msg
+}
+
+func getJSON(uri string, out interface{}) error {
+	resp, err := http.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, uri)
+	}
+	return json.Unmarshal(body, out)
+}
+
+func getSTH(logURI string) (*common.SignedTreeHead, error) {
+	var sth common.SignedTreeHead
+	err := getJSON(fmt.Sprintf("%s/ct/v1/get-sth", logURI), &sth)
+	if err != nil {
+		return nil, err
+	}
+	return &sth, nil
+}
+
+func GetConsistencyProof(logURI string, first, second uint64) ([][32]byte, error) {
+	var encodedProof struct {
+		Consistency [][]byte `json:"consistency"`
+	}
+	err := getJSON(fmt.Sprintf("%s/ct/v1/get-sth-consistency?first=%d&second=%d", logURI, first, second), &encodedProof)
+	if err != nil {
+		return nil, err
+	}
+	proof := make([][32]byte, len(encodedProof.Consistency))
+	for i, node := range encodedProof.Consistency {
+		if len(node) != 32 {
+			return nil, fmt.Errorf("consistency proof node %d has invalid length %d", i, len(node))
+		}
+		copy(proof[i][:], node)
+	}
+	return proof, nil
+}
+
+// updateSTH fetches the current STH from the log and checks that it is signed
+// by the log key and is consistent with the last STH stored for the cache file
+// before storing it.
+func updateSTH(client logClient, key crypto.PublicKey, cacheFilename string) (*common.SignedTreeHead, error) {
+	sth, err := client.getSTH()
+	if err != nil {
+		if _, ok := err.(*inconsistentError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to get log STH: %s", err)
+	}
+	if err = sth.Verify(key); err != nil {
+		return nil, &inconsistentError{fmt.Sprintf("failed to verify log STH: %s", err)}
+	}
+	old, err := common.LatestSTH(cacheFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load stored STH: %s", err)
+	}
+	if old != nil {
+		if sth.TreeSize < old.TreeSize {
+			return nil, &inconsistentError{fmt.Sprintf("log has shrunk from %d to %d entries", old.TreeSize, sth.TreeSize)}
+		}
+		oldRoot, err := old.Root()
+		if err != nil {
+			return nil, fmt.Errorf("stored STH is malformed: %s", err)
+		}
+		newRoot, err := sth.Root()
+		if err != nil {
+			return nil, &inconsistentError{fmt.Sprintf("log STH is malformed: %s", err)}
+		}
+		var proof [][32]byte
+		if old.TreeSize > 0 && sth.TreeSize > old.TreeSize {
+			proof, err = client.getConsistencyProof(old.TreeSize, sth.TreeSize)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get consistency proof: %s", err)
+			}
+		}
+		if err = common.VerifyConsistency(old.TreeSize, sth.TreeSize, oldRoot, newRoot, proof); err != nil {
+			return nil, &inconsistentError{fmt.Sprintf("log is not consistent with stored STH: %s", err)}
+		}
+		if sth.TreeSize == old.TreeSize && sth.Timestamp == old.Timestamp {
+			// nothing new to store
+			return sth, nil
+		}
+	}
+	if err = common.AppendSTH(cacheFilename, sth); err != nil {
+		return nil, fmt.Errorf("failed to store STH: %s", err)
+	}
+	return sth, nil
+}
@@ -0,0 +1,360 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rolandshoemaker/ctat/common"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+const tileWidth = 256
+
+// tileClient fetches entries from a log that uses the static CT API
+// (https://c2sp.org/static-ct-api), where the tree is served as a signed
+// checkpoint and tiles of 256 entries or hashes instead of through get-sth
+// and get-entries. Entries are rebuilt into the same leaf input and extra
+// data a get-entries response would contain so they can be cached as usual.
+type tileClient struct {
+	*logFetcher
+	prefix string
+	logKey []byte
+
+	// size of the tree in the last checkpoint, tiles past it are partial
+	treeSize uint64
+
+	mu      sync.Mutex
+	issuers map[[32]byte][]byte
+}
+
+func newTileClient(prefix string, logKey []byte, config Config) *tileClient {
+	return &tileClient{
+		logFetcher: newLogFetcher(config),
+		prefix:     prefix,
+		logKey:     logKey,
+		issuers:    make(map[[32]byte][]byte),
+	}
+}
+
+func (tc *tileClient) getWithRetries(path string) ([]byte, error) {
+	var body []byte
+	err := tc.retry(func() error {
+		var err error
+		body, err = tc.get(fmt.Sprintf("%s/%s", tc.prefix, path))
+		return err
+	})
+	return body, err
+}
+
+func (tc *tileClient) getSTH() (*common.SignedTreeHead, error) {
+	note, err := tc.getWithRetries("checkpoint")
+	if err != nil {
+		return nil, err
+	}
+	sth, err := parseCheckpoint(note, tc.logKey)
+	if err != nil {
+		return nil, err
+	}
+	tc.treeSize = sth.TreeSize
+	return sth, nil
+}
+
+// parseCheckpoint converts a checkpoint into the STH it was signed as. The
+// log's note signature is a timestamp followed by an RFC 6962 tree head
+// signature, so the result can be verified and stored like any other STH.
+func parseCheckpoint(note, logKey []byte) (*common.SignedTreeHead, error) {
+	text := string(note)
+	split := strings.Index(text, "\n\n")
+	if split < 0 {
+		return nil, fmt.Errorf("malformed checkpoint")
+	}
+	lines := strings.Split(text[:split], "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("malformed checkpoint")
+	}
+	origin := lines[0]
+	treeSize, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checkpoint tree size: %s", err)
+	}
+	root, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(root) != sha256.Size {
+		return nil, fmt.Errorf("malformed checkpoint root hash")
+	}
+
+	// key IDs for RFC 6962 note signatures are the first four bytes of
+	// SHA-256(key name || 0x0A || 0x05 || DER public key)
+	keyID := sha256.Sum256(append([]byte(origin+"\n\x05"), logKey...))
+	for _, line := range strings.Split(text[split+2:], "\n") {
+		if !strings.HasPrefix(line, "— ") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "— "))
+		if len(fields) != 2 || fields[0] != origin {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(sig) < 12 || !bytes.Equal(sig[:4], keyID[:4]) {
+			continue
+		}
+		return &common.SignedTreeHead{
+			TreeSize:          treeSize,
+			Timestamp:         binary.BigEndian.Uint64(sig[4:12]),
+			SHA256RootHash:    root,
+			TreeHeadSignature: sig[12:],
+		}, nil
+	}
+	return nil, &inconsistentError{"checkpoint isn't signed by the log key"}
+}
+
+// tilePath returns the path of a tile, the index is split into groups of
+// three digits with all but the last prefixed with x, and partial tiles have
+// their width appended
+func tilePath(level string, index, width uint64) string {
+	n := fmt.Sprintf("%03d", index%1000)
+	for index >= 1000 {
+		index /= 1000
+		n = fmt.Sprintf("x%03d/%s", index%1000, n)
+	}
+	path := fmt.Sprintf("tile/%s/%s", level, n)
+	if width < tileWidth {
+		path += fmt.Sprintf(".p/%d", width)
+	}
+	return path
+}
+
+// getTile fetches tile index from a level with size entries in the tree
+func (tc *tileClient) getTile(level string, index, size uint64) ([]byte, uint64, error) {
+	width := size - index*tileWidth
+	if width > tileWidth {
+		width = tileWidth
+	}
+	body, err := tc.getWithRetries(tilePath(level, index, width))
+	if se, ok := err.(*statusError); ok && se.code == http.StatusNotFound && width < tileWidth {
+		// partial tiles may be removed once the log has filled them
+		body, err = tc.getWithRetries(tilePath(level, index, tileWidth))
+	}
+	return body, width, err
+}
+
+func (tc *tileClient) getHashTile(level, index, size uint64, cache map[string][][32]byte) ([][32]byte, error) {
+	key := fmt.Sprintf("%d/%d", level, index)
+	if hashes, present := cache[key]; present {
+		return hashes, nil
+	}
+	body, width, err := tc.getTile(strconv.FormatUint(level, 10), index, size)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(body)) < width*sha256.Size {
+		return nil, fmt.Errorf("hash tile %s is %d bytes, expected %d hashes", key, len(body), width)
+	}
+	hashes := make([][32]byte, width)
+	for i := range hashes {
+		copy(hashes[i][:], body[i*sha256.Size:])
+	}
+	cache[key] = hashes
+	return hashes, nil
+}
+
+// subtreeHash returns the Merkle tree hash of the leaves [start, end) of the
+// tree of size treeSize, perfect subtrees are read from the hash tiles
+func (tc *tileClient) subtreeHash(start, end, treeSize uint64, cache map[string][][32]byte) ([32]byte, error) {
+	n := end - start
+	if n&(n-1) != 0 || start%n != 0 {
+		k := uint64(1)
+		for k*2 < n {
+			k *= 2
+		}
+		left, err := tc.subtreeHash(start, start+k, treeSize, cache)
+		if err != nil {
+			return left, err
+		}
+		right, err := tc.subtreeHash(start+k, end, treeSize, cache)
+		if err != nil {
+			return right, err
+		}
+		return common.NodeHash(left, right), nil
+	}
+	height := uint64(0)
+	for uint64(1)<<height < n {
+		height++
+	}
+	// each hash in a level L tile is the root of a subtree of 256^L leaves,
+	// the rest of the height is made up by hashing hashes in the tile
+	level := height / 8
+	first := start >> (8 * level)
+	hashes, err := tc.getHashTile(level, first/tileWidth, treeSize>>(8*level), cache)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	hashes = append([][32]byte{}, hashes[first%tileWidth:first%tileWidth+uint64(1)<<(height%8)]...)
+	for len(hashes) > 1 {
+		for i := 0; i < len(hashes)/2; i++ {
+			hashes[i] = common.NodeHash(hashes[2*i], hashes[2*i+1])
+		}
+		hashes = hashes[:len(hashes)/2]
+	}
+	return hashes[0], nil
+}
+
+func (tc *tileClient) getConsistencyProof(first, second uint64) ([][32]byte, error) {
+	cache := make(map[string][][32]byte)
+	return common.ConsistencyProof(first, second, func(start, end uint64) ([32]byte, error) {
+		return tc.subtreeHash(start, end, second, cache)
+	})
+}
+
+type tileLeaf struct {
+	leafInput []byte
+	entryType ct.LogEntryType
+	precert   []byte
+	chain     [][32]byte
+}
+
+// tlsReader reads TLS encoded fields, after the first error every read
+// returns nothing
+type tlsReader struct {
+	b   []byte
+	err error
+}
+
+func (r *tlsReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = fmt.Errorf("truncated")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *tlsReader) uint(n int) uint64 {
+	v := uint64(0)
+	for _, b := range r.read(n) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (r *tlsReader) vector(lengthBytes int) []byte {
+	return r.read(int(r.uint(lengthBytes)))
+}
+
+// parseDataTile parses the first count TileLeafs in a data tile
+func parseDataTile(data []byte, count uint64) ([]tileLeaf, error) {
+	leaves := []tileLeaf{}
+	r := &tlsReader{b: data}
+	for uint64(len(leaves)) < count {
+		// the TimestampedEntry is the leaf input minus its version and
+		// leaf type
+		entryStart := r.b
+		r.read(8) // timestamp
+		l := tileLeaf{entryType: ct.LogEntryType(r.uint(2))}
+		switch l.entryType {
+		case ct.X509Entry:
+			r.vector(3)
+		case ct.PreCertEntry:
+			r.read(32) // issuer key hash
+			r.vector(3)
+		default:
+			if r.err == nil {
+				return nil, fmt.Errorf("entry %d in data tile has unknown type %d", len(leaves), l.entryType)
+			}
+		}
+		r.vector(2) // extensions
+		if r.err != nil {
+			break
+		}
+		l.leafInput = append([]byte{0, 0}, entryStart[:len(entryStart)-len(r.b)]...)
+		if l.entryType == ct.PreCertEntry {
+			l.precert = r.vector(3)
+		}
+		fingerprints := r.vector(2)
+		if len(fingerprints)%sha256.Size != 0 {
+			return nil, fmt.Errorf("entry %d in data tile has malformed chain fingerprints", len(leaves))
+		}
+		for ; len(fingerprints) > 0; fingerprints = fingerprints[sha256.Size:] {
+			var fp [32]byte
+			copy(fp[:], fingerprints)
+			l.chain = append(l.chain, fp)
+		}
+		if r.err != nil {
+			break
+		}
+		leaves = append(leaves, l)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("data tile is truncated after %d entries", len(leaves))
+	}
+	return leaves, nil
+}
+
+func (tc *tileClient) getIssuer(fingerprint [32]byte) ([]byte, error) {
+	tc.mu.Lock()
+	cert, present := tc.issuers[fingerprint]
+	tc.mu.Unlock()
+	if present {
+		return cert, nil
+	}
+	cert, err := tc.getWithRetries(fmt.Sprintf("issuer/%s", hex.EncodeToString(fingerprint[:])))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(cert) != fingerprint {
+		return nil, fmt.Errorf("issuer %x doesn't match its fingerprint", fingerprint)
+	}
+	tc.mu.Lock()
+	tc.issuers[fingerprint] = cert
+	tc.mu.Unlock()
+	return cert, nil
+}
+
+func (tc *tileClient) fetch(buf *bytes.Buffer, start, end uint64) ([]int64, error) {
+	ends := []int64{}
+	for t := start / tileWidth; t*tileWidth < end; t++ {
+		body, width, err := tc.getTile("data", t, tc.treeSize)
+		if err != nil {
+			return nil, err
+		}
+		leaves, err := parseDataTile(body, width)
+		if err != nil {
+			return nil, fmt.Errorf("data tile %d: %s", t, err)
+		}
+		for i, l := range leaves {
+			index := t*tileWidth + uint64(i)
+			if index < start || index >= end {
+				continue
+			}
+			certs := [][]byte{}
+			if l.entryType == ct.PreCertEntry {
+				certs = append(certs, l.precert)
+			}
+			for _, fp := range l.chain {
+				cert, err := tc.getIssuer(fp)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get issuer for entry %d: %s", index, err)
+				}
+				certs = append(certs, cert)
+			}
+			extraData := common.ExtraData(&ct.Entry{Type: l.entryType, ExtraCerts: certs})
+			if err = common.WriteEntry(buf, l.leafInput, extraData); err != nil {
+				return nil, err
+			}
+			ends = append(ends, int64(buf.Len()))
+		}
+	}
+	return ends, nil
+}
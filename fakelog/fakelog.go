@@ -0,0 +1,333 @@
+package fakelog
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rolandshoemaker/ctat/common"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+type fakeLog struct {
+	file     *os.File
+	treeSize uint64
+	maxBatch uint64
+
+	// only the position and hash of each entry is kept in memory, entries
+	// are read from the cache file when requested
+	offsets    []int64
+	lengths    []int
+	leafHashes [][32]byte
+
+	roots [][]byte
+	sth   *common.SignedTreeHead
+
+	// hashes of complete subtrees, so consistency proofs don't rehash the
+	// whole tree every time
+	sMu      sync.Mutex
+	subtrees map[[2]uint64][32]byte
+}
+
+func loadOrGenerateKey(keyFile string) (crypto.Signer, error) {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("no PEM block in %s", keyFile)
+			}
+			return x509.ParseECPrivateKey(block.Bytes)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (fl *fakeLog) load(entries *common.CacheFile) error {
+	count, err := entries.Count()
+	if err != nil {
+		return err
+	}
+	if _, err = entries.File.Seek(0, 0); err != nil {
+		return err
+	}
+	fl.offsets = make([]int64, count)
+	fl.lengths = make([]int, count)
+	fl.leafHashes = make([][32]byte, count)
+	rMu := new(sync.Mutex)
+	seenRoots := make(map[[32]byte]struct{})
+	var loadErr error
+	err = entries.Map(func(ent *ct.EntryAndPosition, err error) {
+		if ent == nil || ent.Index >= count {
+			rMu.Lock()
+			loadErr = fmt.Errorf("failed to read entry: %s", err)
+			rMu.Unlock()
+			return
+		}
+		fl.offsets[ent.Index] = ent.Offset
+		fl.lengths[ent.Index] = ent.Length
+		fl.leafHashes[ent.Index] = common.LeafHash(ent.Raw)
+		if err != nil || len(ent.Entry.ExtraCerts) == 0 {
+			return
+		}
+		// the last certificate of each chain is one of the roots the log
+		// accepts
+		root := ent.Entry.ExtraCerts[len(ent.Entry.ExtraCerts)-1]
+		fp := sha256.Sum256(root)
+		rMu.Lock()
+		defer rMu.Unlock()
+		if _, present := seenRoots[fp]; !present {
+			seenRoots[fp] = struct{}{}
+			fl.roots = append(fl.roots, root)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return loadErr
+}
+
+// minCachedSubtree is the smallest subtree that is cached, smaller ones are
+// cheap to rehash and there are far too many of them to keep
+var minCachedSubtree = uint64(256)
+
+// subtreeHash returns the Merkle tree hash of the leaves [start, end)
+func (fl *fakeLog) subtreeHash(start, end uint64) [32]byte {
+	n := end - start
+	if n == 0 {
+		return sha256.Sum256(nil)
+	} else if n == 1 {
+		return fl.leafHashes[start]
+	}
+	cache := n >= minCachedSubtree && n&(n-1) == 0
+	if cache {
+		fl.sMu.Lock()
+		h, present := fl.subtrees[[2]uint64{start, n}]
+		fl.sMu.Unlock()
+		if present {
+			return h
+		}
+	}
+	// the left subtree is the largest power of two smaller than n
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	h := common.NodeHash(fl.subtreeHash(start, start+k), fl.subtreeHash(start+k, end))
+	if cache {
+		fl.sMu.Lock()
+		if fl.subtrees == nil {
+			fl.subtrees = make(map[[2]uint64][32]byte)
+		}
+		fl.subtrees[[2]uint64{start, n}] = h
+		fl.sMu.Unlock()
+	}
+	return h
+}
+
+// setTreeSize serves the first treeSize entries with a new STH
+func (fl *fakeLog) setTreeSize(treeSize uint64, signer crypto.Signer) error {
+	root := fl.subtreeHash(0, treeSize)
+	sth := &common.SignedTreeHead{
+		TreeSize:       treeSize,
+		Timestamp:      uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SHA256RootHash: root[:],
+	}
+	if err := sth.Sign(signer); err != nil {
+		return err
+	}
+	fl.treeSize, fl.sth = treeSize, sth
+	return nil
+}
+
+type encodedEntry struct {
+	LeafInput []byte `json:"leaf_input"`
+	ExtraData []byte `json:"extra_data"`
+}
+
+func (fl *fakeLog) readEntries(start, end uint64) ([]encodedEntry, error) {
+	offset := fl.offsets[start]
+	length := fl.offsets[end] + int64(fl.lengths[end]) - offset
+	encoded := make([]encodedEntry, end-start+1)
+	eMu := new(sync.Mutex)
+	var readErr error
+	err := common.MapSection(fl.file, offset, length, func(ent *ct.EntryAndPosition, err error) {
+		if err != nil || ent.Index >= uint64(len(encoded)) {
+			eMu.Lock()
+			readErr = fmt.Errorf("failed to read entry: %s", err)
+			eMu.Unlock()
+			return
+		}
+		encoded[ent.Index] = encodedEntry{LeafInput: ent.Raw, ExtraData: common.ExtraData(ent.Entry)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encoded, readErr
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+func uintParams(r *http.Request, names ...string) ([]uint64, error) {
+	values := []uint64{}
+	for _, n := range names {
+		v, err := strconv.ParseUint(r.URL.Query().Get(n), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid '%s' parameter", n)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (fl *fakeLog) getSTH(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, fl.sth)
+}
+
+func (fl *fakeLog) getEntries(w http.ResponseWriter, r *http.Request) {
+	params, err := uintParams(r, "start", "end")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end := params[0], params[1]
+	if start > end || start >= fl.treeSize {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	// like real logs responses are silently truncated
+	if end >= fl.treeSize {
+		end = fl.treeSize - 1
+	}
+	if end-start+1 > fl.maxBatch {
+		end = start + fl.maxBatch - 1
+	}
+	entries, err := fl.readEntries(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Entries []encodedEntry `json:"entries"`
+	}{entries})
+}
+
+func (fl *fakeLog) getRoots(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, struct {
+		Certificates [][]byte `json:"certificates"`
+	}{fl.roots})
+}
+
+func (fl *fakeLog) getConsistency(w http.ResponseWriter, r *http.Request) {
+	params, err := uintParams(r, "first", "second")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	first, second := params[0], params[1]
+	if first == 0 || first > second || second > fl.treeSize {
+		http.Error(w, "invalid tree sizes", http.StatusBadRequest)
+		return
+	}
+	proof, _ := common.ConsistencyProof(first, second, func(start, end uint64) ([32]byte, error) {
+		return fl.subtreeHash(start, end), nil
+	})
+	encoded := make([][]byte, len(proof))
+	for i := range proof {
+		encoded[i] = proof[i][:]
+	}
+	writeJSON(w, struct {
+		Consistency [][]byte `json:"consistency"`
+	}{encoded})
+}
+
+// Serve serves the first treeSize entries of a cache file (or all of them if
+// treeSize is 0) using the RFC 6962 API. STHs are signed with the ECDSA key in
+// keyFile, which is generated if it doesn't exist or if keyFile is empty.
+func Serve(cacheFile, keyFile, listenAddr string, treeSize, maxBatch uint64) error {
+	signer, err := loadOrGenerateKey(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load log key: %s", err)
+	}
+	if err = common.RequireUncompressed(cacheFile); err != nil {
+		return err
+	}
+	entries, err := common.LoadCacheFile(cacheFile)
+	if err != nil {
+		return err
+	}
+	defer entries.Close()
+
+	fl := &fakeLog{file: entries.File, maxBatch: maxBatch}
+	fmt.Println("loading entries from cache file...")
+	if err = fl.load(entries); err != nil {
+		return fmt.Errorf("failed to load cache file: %s", err)
+	}
+	if treeSize == 0 {
+		treeSize = uint64(len(fl.leafHashes))
+	} else if treeSize > uint64(len(fl.leafHashes)) {
+		return fmt.Errorf("cache file only contains %d entries", len(fl.leafHashes))
+	}
+	if fl.maxBatch == 0 {
+		fl.maxBatch = 1000
+	}
+	if err = fl.setTreeSize(treeSize, signer); err != nil {
+		return fmt.Errorf("failed to sign STH: %s", err)
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("serving %d entries (%d roots) on %s\n", fl.treeSize, len(fl.roots), listenAddr)
+	fmt.Printf("log key: %s\n", base64.StdEncoding.EncodeToString(publicKey))
+
+	return http.ListenAndServe(listenAddr, fl.handler())
+}
+
+func (fl *fakeLog) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ct/v1/get-sth", fl.getSTH)
+	mux.HandleFunc("/ct/v1/get-entries", fl.getEntries)
+	mux.HandleFunc("/ct/v1/get-roots", fl.getRoots)
+	mux.HandleFunc("/ct/v1/get-sth-consistency", fl.getConsistency)
+	return mux
+}
@@ -0,0 +1,120 @@
+package fakelog
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rolandshoemaker/ctat/common"
+	"github.com/rolandshoemaker/ctat/downloader"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// TestDownload serves a cache file and downloads it in two steps, so the
+// second download has to check a consistency proof against the first STH,
+// then checks every consistency proof the log serves
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ctat-fakelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th := new(common.TreeHasher)
+	roots := [][32]byte{th.Root()}
+	for i := 0; i < 37; i++ {
+		e := &ct.Entry{
+			Timestamp:  1451606400000 + uint64(i),
+			Type:       ct.X509Entry,
+			X509Cert:   []byte(fmt.Sprintf("leaf certificate %d", i)),
+			ExtraCerts: [][]byte{[]byte("intermediate"), []byte("root")},
+		}
+		leaf := common.MarshalLeaf(e)
+		if err = common.WriteEntry(f, leaf, common.ExtraData(e)); err != nil {
+			t.Fatal(err)
+		}
+		th.Add(common.LeafHash(leaf))
+		roots = append(roots, th.Root())
+	}
+	f.Close()
+
+	entries, err := common.LoadCacheFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer entries.Close()
+	fl := &fakeLog{file: entries.File, maxBatch: 5}
+	if err = fl.load(entries); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := loadOrGenerateKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// small enough that the proofs below use cached subtrees
+	minCachedSubtree = 4
+	srv := httptest.NewServer(fl.handler())
+	defer srv.Close()
+
+	dst := filepath.Join(dir, "dst")
+	config := downloader.Config{Workers: 3, ChunkSize: 4, BatchSize: 3, Output: ioutil.Discard}
+	for _, size := range []uint64{20, 37} {
+		if err = fl.setTreeSize(size, signer); err != nil {
+			t.Fatal(err)
+		}
+		if err = downloader.Download(srv.URL, publicKey, dst, config); err != nil {
+			t.Fatalf("failed to download %d entries: %s", size, err)
+		}
+		sth, err := common.LatestSTH(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sth.TreeSize != size {
+			t.Fatalf("stored STH has tree size %d, expected %d", sth.TreeSize, size)
+		}
+		if err = sth.Verify(signer.Public()); err != nil {
+			t.Fatalf("stored STH has a bad signature: %s", err)
+		}
+		if root, err := sth.Root(); err != nil || root != roots[size] {
+			t.Fatalf("stored STH for %d entries has the wrong root hash", size)
+		}
+	}
+	srcData, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstData, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(srcData, dstData) {
+		t.Fatal("downloaded cache differs from the served cache")
+	}
+
+	for first := uint64(1); first <= 37; first++ {
+		for second := first; second <= 37; second++ {
+			proof, err := downloader.GetConsistencyProof(srv.URL, first, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = common.VerifyConsistency(first, second, roots[first], roots[second], proof); err != nil {
+				t.Fatalf("bad consistency proof from %d to %d: %s", first, second, err)
+			}
+		}
+	}
+}
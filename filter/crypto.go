@@ -0,0 +1,178 @@
+package filter
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var SigAlgToString = map[x509.SignatureAlgorithm]string{
+	0:  "Unknown",
+	1:  "MD2 With RSA",
+	2:  "MD5 With RSA",
+	3:  "SHA1 With RSA",
+	4:  "SHA256 With RSA",
+	5:  "SHA384 With RSA",
+	6:  "SHA512 With RSA",
+	7:  "DSA With SHA1",
+	8:  "DSA With SHA256",
+	9:  "ECDSA With SHA1",
+	10: "ECDSA With SHA256",
+	11: "ECDSA With SHA384",
+	12: "ECDSA With SHA512",
+}
+
+// KeyType returns the type of a certificates public key, RSA, DSA or ECDSA,
+// or an empty string if it's something else
+func KeyType(cert *x509.Certificate) string {
+	switch cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *dsa.PublicKey:
+		return "DSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	}
+	return ""
+}
+
+// KeySize returns the size of a certificates public key in bits, or 0 if
+// KeyType doesn't know the type
+func KeySize(cert *x509.Certificate) int {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *dsa.PublicKey:
+		return k.Y.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Params().BitSize
+	}
+	return 0
+}
+
+// normalizeAlg makes algorithm names comparable regardless of case and
+// separators, so sha1WithRSA, SHA1-With-RSA and "SHA1 With RSA" all match
+func normalizeAlg(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '_' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(name))
+}
+
+func KeyTypeFilter(types []string) (Filter, error) {
+	set := make(map[string]struct{}, len(types))
+	for _, t := range types {
+		upper := strings.ToUpper(t)
+		if upper != "RSA" && upper != "DSA" && upper != "ECDSA" {
+			return nil, fmt.Errorf("unknown key type '%s', expected RSA, DSA or ECDSA", t)
+		}
+		set[upper] = struct{}{}
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[KeyType(cert)]
+		return !present, nil
+	}, nil
+}
+
+// KeySizeFilter keeps certificates with keys of one of the given sizes, sizes
+// are either a number of bits or an inclusive range like 1024-2047
+func KeySizeFilter(sizes []string) (Filter, error) {
+	type sizeRange struct{ min, max int }
+	ranges := []sizeRange{}
+	for _, s := range sizes {
+		bounds := strings.SplitN(s, "-", 2)
+		min, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key size '%s'", s)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(bounds[1]); err != nil || max < min {
+				return nil, fmt.Errorf("invalid key size range '%s'", s)
+			}
+		}
+		ranges = append(ranges, sizeRange{min, max})
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		size := KeySize(cert)
+		for _, r := range ranges {
+			if size >= r.min && size <= r.max {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+// SigAlgFilter keeps certificates signed with one of the given algorithms,
+// names are those from SigAlgToString
+func SigAlgFilter(algs []string) (Filter, error) {
+	known := make(map[string]x509.SignatureAlgorithm, len(SigAlgToString))
+	for alg, name := range SigAlgToString {
+		known[normalizeAlg(name)] = alg
+	}
+	set := make(map[x509.SignatureAlgorithm]struct{}, len(algs))
+	for _, a := range algs {
+		alg, present := known[normalizeAlg(a)]
+		if !present {
+			return nil, fmt.Errorf("unknown signature algorithm '%s'", a)
+		}
+		set[alg] = struct{}{}
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[cert.SignatureAlgorithm]
+		return !present, nil
+	}, nil
+}
+
+// sigHash returns the hash part of a signature algorithm name
+func sigHash(alg x509.SignatureAlgorithm) string {
+	name, present := SigAlgToString[alg]
+	if !present {
+		return ""
+	}
+	for _, part := range strings.Split(name, " With ") {
+		if part != "RSA" && part != "DSA" && part != "ECDSA" {
+			return part
+		}
+	}
+	return ""
+}
+
+// SigHashFilter keeps certificates signed using one of the given hashes (MD2,
+// MD5, SHA1, SHA256, SHA384 or SHA512) whatever the key type
+func SigHashFilter(hashes []string) (Filter, error) {
+	known := make(map[string]string)
+	for alg := range SigAlgToString {
+		if h := sigHash(alg); h != "" {
+			known[normalizeAlg(h)] = h
+		}
+	}
+	set := make(map[string]struct{}, len(hashes))
+	for _, h := range hashes {
+		hash, present := known[normalizeAlg(h)]
+		if !present {
+			return nil, fmt.Errorf("unknown signature hash '%s'", h)
+		}
+		set[hash] = struct{}{}
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[sigHash(cert.SignatureAlgorithm)]
+		return !present, nil
+	}, nil
+}
+
+func listFilter(constructor func([]string) (Filter, error)) func([]string) (Filter, error) {
+	return func(args []string) (Filter, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("expected at least one argument")
+		}
+		return constructor(args)
+	}
+}
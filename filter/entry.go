@@ -0,0 +1,151 @@
+package filter
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"time"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// EntryFilter is a Filter that can also see the log entry a certificate came
+// from. The entry is nil for certificates that didn't come from a log (roots
+// loaded from a file for instance), filters that only look at the entry keep
+// those.
+type EntryFilter func(*ct.EntryAndPosition, *x509.Certificate) (bool, error)
+
+// Entry turns a Filter into an EntryFilter that ignores the entry
+func Entry(f Filter) EntryFilter {
+	return func(_ *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		return f(cert)
+	}
+}
+
+// ParamEntryFilterMap contains filters on log metadata, for example
+// indexRange(0, 1000000) or loggedBetween(2016-01-01, 2016-02-01)
+var ParamEntryFilterMap = map[string]func(args []string) (EntryFilter, error){
+	"indexRange": func(args []string) (EntryFilter, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected a start and end index")
+		}
+		start, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start index '%s'", args[0])
+		}
+		end, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end index '%s'", args[1])
+		}
+		return IndexRangeFilter(start, end), nil
+	},
+	"loggedBetween": func(args []string) (EntryFilter, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("expected a start and end date")
+		}
+		from, err := ParseTime(args[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := ParseTime(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return LoggedBetweenFilter(from, to), nil
+	},
+	"chainLength": func(args []string) (EntryFilter, error) {
+		if len(args) != 1 && len(args) != 2 {
+			return nil, fmt.Errorf("expected a minimum and optional maximum length")
+		}
+		lengths := []int{}
+		for _, a := range args {
+			l, err := strconv.Atoi(a)
+			if err != nil || l < 0 {
+				return nil, fmt.Errorf("invalid chain length '%s'", a)
+			}
+			lengths = append(lengths, l)
+		}
+		if len(lengths) == 1 {
+			// no maximum
+			lengths = append(lengths, -1)
+		}
+		return ChainLengthFilter(lengths[0], lengths[1]), nil
+	},
+	"entryType": func(args []string) (EntryFilter, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected 'x509' or 'precert'")
+		}
+		switch args[0] {
+		case "x509":
+			return EntryTypeFilter(ct.X509Entry), nil
+		case "precert":
+			return EntryTypeFilter(ct.PreCertEntry), nil
+		}
+		return nil, fmt.Errorf("unknown entry type '%s', expected 'x509' or 'precert'", args[0])
+	},
+	// issuerFingerprint matches the leaf's issuing certificate in the entry's
+	// chain rather than files of issuer certificates like issuerCert
+	"issuerFingerprint": func(args []string) (EntryFilter, error) {
+		fps, err := expandNameArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return IssuerFingerprintFilter(fps)
+	},
+	// sample(0.01) or sample(0.01, seed) keeps the same 1% of entries on
+	// every run
+	"sample": sampleFilter,
+}
+
+// IndexRangeFilter keeps entries with start <= index < end
+func IndexRangeFilter(start, end uint64) EntryFilter {
+	return func(ent *ct.EntryAndPosition, _ *x509.Certificate) (bool, error) {
+		if ent == nil {
+			return false, nil
+		}
+		return ent.Index < start || ent.Index >= end, nil
+	}
+}
+
+// LoggedBetweenFilter keeps entries whose Merkle tree leaf timestamp (when the
+// log says it accepted the entry) is in [from, to)
+func LoggedBetweenFilter(from, to time.Time) EntryFilter {
+	return func(ent *ct.EntryAndPosition, _ *x509.Certificate) (bool, error) {
+		if ent == nil {
+			return false, nil
+		}
+		logged := time.Unix(0, int64(ent.Entry.Timestamp)*int64(time.Millisecond))
+		return logged.Before(from) || !logged.Before(to), nil
+	}
+}
+
+// chain returns the certificates an entry was submitted with, not including
+// the precertificate itself for precertificate entries
+func chain(entry *ct.Entry) [][]byte {
+	if entry.Type == ct.PreCertEntry && len(entry.ExtraCerts) > 0 {
+		return entry.ExtraCerts[1:]
+	}
+	return entry.ExtraCerts
+}
+
+// ChainLengthFilter keeps entries submitted with between min and max (inclusive)
+// chain certificates, a negative max means there is no maximum
+func ChainLengthFilter(min, max int) EntryFilter {
+	return func(ent *ct.EntryAndPosition, _ *x509.Certificate) (bool, error) {
+		if ent == nil {
+			return false, nil
+		}
+		l := len(chain(ent.Entry))
+		return l < min || (max >= 0 && l > max), nil
+	}
+}
+
+// EntryTypeFilter keeps entries of a single type
+func EntryTypeFilter(entryType ct.LogEntryType) EntryFilter {
+	return func(ent *ct.EntryAndPosition, _ *x509.Certificate) (bool, error) {
+		if ent == nil {
+			return false, nil
+		}
+		return ent.Entry.Type != entryType, nil
+	}
+}
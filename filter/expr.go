@@ -0,0 +1,453 @@
+package filter
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// ParamFilterMap contains filters that take arguments, for example
+// issuerCN("Let's Encrypt Authority X1") or notBeforeAfter:2016-01-01
+var ParamFilterMap = map[string]func(args []string) (Filter, error){
+	"notBeforeAfter":  timeFilter(NotBeforeAfterFilter),
+	"notBeforeBefore": timeFilter(NotBeforeBeforeFilter),
+	"notAfterAfter":   timeFilter(NotAfterAfterFilter),
+	"notAfterBefore":  timeFilter(NotAfterBeforeFilter),
+	"validAt":         timeFilter(ValidAtFilter),
+	// name filters take a list of names, arguments starting with @ are
+	// files to load names from
+	"name":       nameListFilter(NameFilter),
+	"nameSuffix": nameListFilter(NameSuffixFilter),
+	"domain":     nameListFilter(DomainFilter),
+	"nameRegex": func(args []string) (Filter, error) {
+		patterns, err := expandNameArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return NameRegexFilter(patterns)
+	},
+	// issuer filters take lists too, so all of a CA's intermediates can be
+	// matched at once
+	"issuerCN":  nameListFilter(IssuerCNsFilter),
+	"issuerDN":  nameListFilter(IssuerDNFilter),
+	"issuerOrg": nameListFilter(IssuerOrgFilter),
+	"aki": func(args []string) (Filter, error) {
+		ids, err := expandNameArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return AKIFilter(ids)
+	},
+	"issuerCert": issuerCertFilter,
+	// key and signature filters, e.g. keyType(RSA) and keySize(1024) or
+	// sigHash(SHA1)
+	"keyType": listFilter(KeyTypeFilter),
+	"keySize": listFilter(KeySizeFilter),
+	"sigAlg":  listFilter(SigAlgFilter),
+	"sigHash": listFilter(SigHashFilter),
+}
+
+func timeFilter(constructor func(time.Time) Filter) func([]string) (Filter, error) {
+	return func(args []string) (Filter, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a date")
+		}
+		t, err := ParseTime(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return constructor(t), nil
+	}
+}
+
+// predicate is the opposite of an EntryFilter, it returns true if a
+// certificate should be kept, which is easier to reason about when combining
+// them
+type predicate func(*ct.EntryAndPosition, *x509.Certificate) (bool, error)
+
+func (p predicate) filter() EntryFilter {
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		keep, err := p(ent, cert)
+		return !keep, err
+	}
+}
+
+func fromFilter(f EntryFilter) predicate {
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		skip, err := f(ent, cert)
+		return !skip, err
+	}
+}
+
+// lookupParam finds the constructor for a filter that takes arguments
+func lookupParam(name string) (func([]string) (EntryFilter, error), bool) {
+	if constructor, present := ParamFilterMap[name]; present {
+		return func(args []string) (EntryFilter, error) {
+			f, err := constructor(args)
+			if err != nil {
+				return nil, err
+			}
+			return Entry(f), nil
+		}, true
+	}
+	constructor, present := ParamEntryFilterMap[name]
+	return constructor, present
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenColon
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.value)
+	}
+	return fmt.Sprintf("'%s'", t.value)
+}
+
+func isWordChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-*@/:", r)
+}
+
+func isFilterName(name string) bool {
+	if _, present := FilterMap[name]; present {
+		return true
+	}
+	_, present := lookupParam(name)
+	return present
+}
+
+// tokenize splits a filter expression into tokens. Words can contain colons
+// (dates like 2016-01-01T00:00:00Z or AKIs like AB:CD:EF), a colon is only the
+// name:value shorthand when it comes right after a filter name, in which case
+// the value runs up to whitespace, ',' or ')' and can contain colons too.
+func tokenize(expr string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+			i++
+		case r == '"':
+			t, end, err := readString(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+			i = end
+		case isWordChar(r) && r != ':':
+			start := i
+			for i < len(runes) && isWordChar(runes[i]) {
+				if runes[i] == ':' && isFilterName(string(runes[start:i])) {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[start:i]), start})
+			if i == len(runes) || runes[i] != ':' {
+				continue
+			}
+			tokens = append(tokens, token{tokenColon, ":", i})
+			i++
+			if i < len(runes) && runes[i] == '"' {
+				t, end, err := readString(runes, i)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, t)
+				i = end
+				continue
+			}
+			start = i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != ',' && runes[i] != ')' {
+				i++
+			}
+			if i > start {
+				tokens = append(tokens, token{tokenWord, string(runes[start:i]), start})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", r, i)
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(runes)}), nil
+}
+
+// readString reads the quoted string starting at runes[start], returning it
+// and the position after the closing quote
+func readString(runes []rune, start int) (token, int, error) {
+	i := start + 1
+	for ; i < len(runes) && runes[i] != '"'; i++ {
+		if runes[i] == '\\' {
+			i++
+		}
+	}
+	if i >= len(runes) {
+		return token{}, 0, fmt.Errorf("unterminated string at position %d", start)
+	}
+	i++
+	value, err := strconv.Unquote(string(runes[start:i]))
+	if err != nil {
+		return token{}, 0, fmt.Errorf("invalid string at position %d: %s", start, err)
+	}
+	return token{tokenString, value, start}, i, nil
+}
+
+// parser is a recursive descent parser for filter expressions
+//
+//	list    = expr { "," expr }
+//	expr    = and { "or" and }
+//	and     = not { "and" not }
+//	not     = "not" not | primary
+//	primary = "(" expr ")" | name [ "(" [ value { "," value } ] ")" | ":" value ]
+//	value   = word | string
+//
+// a comma separated list of filters must all pass, which keeps the original
+// --filters format working
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokenWord && t.value == word
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s but found %s at position %d", what, t, t.pos)
+	}
+	return t, nil
+}
+
+func (p *parser) parseExpr() (predicate, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (predicate, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = and(left, right)
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (predicate, error) {
+	if p.isKeyword("not") {
+		p.next()
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not(inner), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (predicate, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		inner, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err = p.expect(tokenRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	case tokenWord:
+		if t.value == "and" || t.value == "or" || t.value == "not" {
+			break
+		}
+		if p.peek().kind != tokenLParen && p.peek().kind != tokenColon {
+			f, present := FilterMap[t.value]
+			if !present {
+				if _, present = lookupParam(t.value); present {
+					return nil, fmt.Errorf("filter '%s' at position %d needs arguments", t.value, t.pos)
+				}
+				return nil, fmt.Errorf("unknown filter '%s' at position %d", t.value, t.pos)
+			}
+			return fromFilter(Entry(f)), nil
+		}
+		var args []string
+		if p.next().kind == tokenColon {
+			// name:value is shorthand for name(value)
+			arg := p.next()
+			if arg.kind != tokenWord && arg.kind != tokenString {
+				return nil, fmt.Errorf("expected an argument but found %s at position %d", arg, arg.pos)
+			}
+			args = []string{arg.value}
+		} else {
+			var err error
+			if args, err = p.parseArgs(); err != nil {
+				return nil, err
+			}
+		}
+		constructor, present := lookupParam(t.value)
+		if !present {
+			if _, present = FilterMap[t.value]; present {
+				return nil, fmt.Errorf("filter '%s' at position %d doesn't take arguments", t.value, t.pos)
+			}
+			return nil, fmt.Errorf("unknown filter '%s' at position %d", t.value, t.pos)
+		}
+		f, err := constructor(args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid arguments for '%s' at position %d: %s", t.value, t.pos, err)
+		}
+		return fromFilter(f), nil
+	}
+	return nil, fmt.Errorf("expected a filter but found %s at position %d", t, t.pos)
+}
+
+// parseArgs parses the arguments after an opening parenthesis up to and
+// including the closing one
+func (p *parser) parseArgs() ([]string, error) {
+	args := []string{}
+	if p.peek().kind == tokenRParen {
+		p.next()
+		return args, nil
+	}
+	for {
+		t := p.next()
+		if t.kind != tokenWord && t.kind != tokenString {
+			return nil, fmt.Errorf("expected an argument but found %s at position %d", t, t.pos)
+		}
+		args = append(args, t.value)
+		t = p.next()
+		if t.kind == tokenRParen {
+			return args, nil
+		}
+		if t.kind != tokenComma {
+			return nil, fmt.Errorf("expected ',' or ')' but found %s at position %d", t, t.pos)
+		}
+	}
+}
+
+func and(left, right predicate) predicate {
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		keep, err := left(ent, cert)
+		if err != nil || !keep {
+			return false, err
+		}
+		return right(ent, cert)
+	}
+}
+
+func or(left, right predicate) predicate {
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		keep, err := left(ent, cert)
+		if err != nil || keep {
+			return keep, err
+		}
+		return right(ent, cert)
+	}
+}
+
+func not(inner predicate) predicate {
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		keep, err := inner(ent, cert)
+		return !keep, err
+	}
+}
+
+// StringToFilters compiles a filter expression, each comma separated
+// expression becomes a separate EntryFilter
+func StringToFilters(arg string) ([]EntryFilter, error) {
+	filters, _, err := StringToNamedFilters(arg)
+	return filters, err
+}
+
+// StringToNamedFilters is StringToFilters that also returns the source of each
+// comma separated expression so what each filter does can be reported
+func StringToNamedFilters(arg string) ([]EntryFilter, []string, error) {
+	tokens, err := tokenize(arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	runes := []rune(arg)
+	p := &parser{tokens: tokens}
+	filters := []EntryFilter{}
+	names := []string{}
+	for {
+		start := p.peek().pos
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, nil, err
+		}
+		t := p.next()
+		if t.kind != tokenEOF && t.kind != tokenComma {
+			return nil, nil, fmt.Errorf("expected 'and', 'or' or ',' but found %s at position %d", t, t.pos)
+		}
+		filters = append(filters, expr.filter())
+		names = append(names, strings.TrimSpace(string(runes[start:t.pos])))
+		if t.kind == tokenEOF {
+			return filters, names, nil
+		}
+	}
+}
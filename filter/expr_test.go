@@ -0,0 +1,131 @@
+package filter
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func keeps(t *testing.T, expr string, cert *x509.Certificate) bool {
+	filters, err := StringToFilters(expr)
+	if err != nil {
+		t.Fatalf("%q: %s", expr, err)
+	}
+	for _, f := range filters {
+		skip, err := f(nil, cert)
+		if err != nil {
+			t.Fatalf("%q: %s", expr, err)
+		}
+		if skip {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExpressions(t *testing.T) {
+	leaf := &x509.Certificate{
+		Issuer:   pkix.Name{CommonName: "Issuer X"},
+		NotAfter: time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	ca := &x509.Certificate{
+		IsCA:     true,
+		Issuer:   pkix.Name{CommonName: "Root Y"},
+		NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	SetAsOf(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	defer SetAsOf(time.Time{})
+
+	cases := []struct {
+		expr     string
+		leaf, ca bool
+	}{
+		{"leafOnly", true, false},
+		{"caOnly", false, true},
+		// not
+		{"not leafOnly", false, true},
+		{"not not leafOnly", true, false},
+		{"not leafOnly and unexpired", false, true},
+		// and binds tighter than or
+		{`caOnly or leafOnly and issuerCN("Nobody")`, false, true},
+		{`leafOnly and issuerCN("Nobody") or caOnly`, false, true},
+		{"leafOnly or caOnly and expired", true, false},
+		// parentheses
+		{`(caOnly or leafOnly) and issuerCN("Nobody")`, false, false},
+		{"leafOnly or (caOnly and expired)", true, false},
+		{"(leafOnly or caOnly) and expired", true, false},
+		{`not (leafOnly or issuerCN("Root Y"))`, false, false},
+		{"((leafOnly))", true, false},
+		// the original comma separated list, every filter must keep
+		{"unexpired", false, true},
+		{"unexpired,caOnly", false, true},
+		{"expired, leafOnly", true, false},
+		{"expired,caOnly", false, false},
+		{"leafOnly or caOnly, unexpired", false, true},
+		// quoted strings, escapes, and the name:value shorthand
+		{`issuerCN("Issuer X")`, true, false},
+		{`issuerCN("Issuer X", "Root Y")`, true, true},
+		{`issuerCN:"Root Y"`, false, true},
+		{`issuerCN("Issuer \"X\"")`, false, false},
+		{`issuerCN("Issuer\u0020X")`, true, false},
+		{`issuerCN("Root Y", "a,b) or (c")`, false, true},
+		{"notAfterBefore:2020-01-01T00:00:00Z", true, false},
+		{"notAfterBefore(2020-01-01T00:00:00Z)", true, false},
+		{"validAt:2016-01-01 and not caOnly", true, false},
+	}
+	for _, tc := range cases {
+		if got := keeps(t, tc.expr, leaf); got != tc.leaf {
+			t.Errorf("%q: kept leaf = %t, expected %t", tc.expr, got, tc.leaf)
+		}
+		if got := keeps(t, tc.expr, ca); got != tc.ca {
+			t.Errorf("%q: kept CA = %t, expected %t", tc.expr, got, tc.ca)
+		}
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	cases := []struct {
+		expr string
+		err  string
+	}{
+		{"", "expected a filter but found end of expression at position 0"},
+		{"foo", "unknown filter 'foo' at position 0"},
+		{"leafOnly and foo(1)", "unknown filter 'foo' at position 13"},
+		{"issuerCN", "filter 'issuerCN' at position 0 needs arguments"},
+		{"leafOnly(1)", "filter 'leafOnly' at position 0 doesn't take arguments"},
+		{"issuerCN()", "invalid arguments for 'issuerCN' at position 0: expected at least one name"},
+		{"validAt(2016-01-01, 2016-01-02)", "invalid arguments for 'validAt' at position 0: expected a date"},
+		{"validAt:", "expected an argument but found end of expression at position 8"},
+		{"issuerCN(a b)", "expected ',' or ')' but found 'b' at position 11"},
+		{"issuerCN(a,)", "expected an argument but found ')' at position 11"},
+		{"leafOnly and", "expected a filter but found end of expression at position 12"},
+		{"not", "expected a filter but found end of expression at position 3"},
+		{"(leafOnly", "expected ')' but found end of expression at position 9"},
+		{"leafOnly)", "expected 'and', 'or' or ',' but found ')' at position 8"},
+		{"leafOnly caOnly", "expected 'and', 'or' or ',' but found 'caOnly' at position 9"},
+		{"leafOnly,", "expected a filter but found end of expression at position 9"},
+		{`"leafOnly"`, `expected a filter but found "leafOnly" at position 0`},
+		{"leafOnly $", "unexpected character '$' at position 9"},
+		{`issuerCN("a`, "unterminated string at position 9"},
+		{`issuerCN("\q")`, "invalid string at position 9: invalid syntax"},
+	}
+	for _, tc := range cases {
+		_, err := StringToFilters(tc.expr)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.expr)
+		} else if err.Error() != tc.err {
+			t.Errorf("%q: got error %q, expected %q", tc.expr, err, tc.err)
+		}
+	}
+}
+
+func TestExpressionNames(t *testing.T) {
+	_, names, err := StringToNamedFilters(` leafOnly or caOnly ,issuerCN("a, b")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "leafOnly or caOnly" || names[1] != `issuerCN("a, b")` {
+		t.Errorf("unexpected names %q", names)
+	}
+}
@@ -3,7 +3,6 @@ package filter
 import (
 	"crypto/x509"
 	"fmt"
-	"strings"
 	"time"
 )
 
@@ -16,27 +15,45 @@ var FilterMap = map[string]Filter{
 
 type Filter func(*x509.Certificate) (bool, error)
 
-func StringToFilters(arg string) ([]Filter, error) {
-	filters := []Filter{}
-	for _, a := range strings.Split(arg, ",") {
-		if filter, present := FilterMap[a]; present {
-			filters = append(filters, filter)
-		} else if !present {
-			return nil, fmt.Errorf("invalid filter")
-		}
+// asOf is the time that time dependent filters compare against, the current
+// time is used if it isn't set
+var asOf time.Time
+
+// SetAsOf fixes the reference time for time dependent filters so analyses can
+// be reproduced later
+func SetAsOf(t time.Time) {
+	asOf = t
+}
+
+func now() time.Time {
+	if asOf.IsZero() {
+		return time.Now()
+	}
+	return asOf
+}
+
+// ParseTime parses a date (2006-01-02, taken as midnight UTC) or an RFC 3339
+// timestamp
+func ParseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s', expected YYYY-MM-DD or an RFC 3339 timestamp", value)
 	}
-	return filters, nil
+	return t, nil
 }
 
 func UnexpiredFilter(cert *x509.Certificate) (bool, error) {
-	if time.Now().After(cert.NotAfter) {
+	if now().After(cert.NotAfter) {
 		return true, nil
 	}
 	return false, nil
 }
 
 func ExpiredFilter(cert *x509.Certificate) (bool, error) {
-	if !time.Now().After(cert.NotAfter) {
+	if !now().After(cert.NotAfter) {
 		return true, nil
 	}
 	return false, nil
@@ -64,3 +81,36 @@ func IssuerCNFilter(commonName string) func(*x509.Certificate) (bool, error) {
 		return false, nil
 	}
 }
+
+func NotBeforeAfterFilter(t time.Time) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		return !cert.NotBefore.After(t), nil
+	}
+}
+
+func NotBeforeBeforeFilter(t time.Time) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		return !cert.NotBefore.Before(t), nil
+	}
+}
+
+func NotAfterAfterFilter(t time.Time) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		return !cert.NotAfter.After(t), nil
+	}
+}
+
+func NotAfterBeforeFilter(t time.Time) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		return !cert.NotAfter.Before(t), nil
+	}
+}
+
+func ValidAtFilter(t time.Time) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		if t.Before(cert.NotBefore) || t.After(cert.NotAfter) {
+			return true, nil
+		}
+		return false, nil
+	}
+}
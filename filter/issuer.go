@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+func escape(str string) string {
+	return strings.Replace(str, ",", " -", -1)
+}
+
+func SubjectToString(subject pkix.Name) string {
+	out := []string{}
+	if subject.CommonName != "" {
+		out = append(out, fmt.Sprintf("CN=%s", escape(subject.CommonName)))
+	}
+	if len(subject.Organization) != 0 {
+		out = append(out, fmt.Sprintf("O=[%s]", escape(strings.Join(subject.Organization, " -- "))))
+	}
+	if len(subject.OrganizationalUnit) != 0 {
+		out = append(out, fmt.Sprintf("OU=[%s]", escape(strings.Join(subject.OrganizationalUnit, " -- "))))
+	}
+	if len(subject.Locality) != 0 {
+		out = append(out, fmt.Sprintf("L=[%s]", escape(strings.Join(subject.Locality, " -- "))))
+	}
+	if len(subject.Province) != 0 {
+		out = append(out, fmt.Sprintf("ST=[%s]", escape(strings.Join(subject.Province, " -- "))))
+	}
+	if len(subject.Country) != 0 {
+		out = append(out, fmt.Sprintf("C=[%s]", escape(strings.Join(subject.Country, " -- "))))
+	}
+	if len(out) == 0 {
+		return "???"
+	}
+	return strings.Join(out, "; ")
+}
+
+func stringSet(values []string, normalize func(string) string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[normalize(v)] = struct{}{}
+	}
+	return set
+}
+
+// IssuerCNsFilter keeps certificates whose issuer common name is one of names
+func IssuerCNsFilter(names []string) Filter {
+	set := stringSet(names, strings.TrimSpace)
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[cert.Issuer.CommonName]
+		return !present, nil
+	}
+}
+
+// IssuerDNFilter keeps certificates whose issuer, formatted by
+// SubjectToString, is one of dns
+func IssuerDNFilter(dns []string) Filter {
+	set := stringSet(dns, strings.TrimSpace)
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[SubjectToString(cert.Issuer)]
+		return !present, nil
+	}
+}
+
+// IssuerOrgFilter keeps certificates with an issuer organisation in orgs,
+// ignoring case
+func IssuerOrgFilter(orgs []string) Filter {
+	set := stringSet(orgs, func(s string) string { return strings.ToLower(strings.TrimSpace(s)) })
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, o := range cert.Issuer.Organization {
+			if _, present := set[strings.ToLower(o)]; present {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+func parseHex(value string) ([]byte, error) {
+	value = strings.Replace(strings.TrimSpace(value), ":", "", -1)
+	return hex.DecodeString(value)
+}
+
+// AKIFilter keeps certificates with one of the hex encoded authority key
+// identifiers in ids, colons between bytes are ignored (aki(AB:CD:EF) works
+// without quoting)
+func AKIFilter(ids []string) (Filter, error) {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		decoded, err := parseHex(id)
+		if err != nil || len(decoded) == 0 {
+			return nil, fmt.Errorf("invalid key identifier '%s'", id)
+		}
+		set[string(decoded)] = struct{}{}
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		_, present := set[string(cert.AuthorityKeyId)]
+		return !present, nil
+	}, nil
+}
+
+// IssuerCertFilter keeps certificates issued by one of issuers, a certificate
+// is taken to be issued by an issuer if its issuer name is the issuer's
+// subject and its authority key identifier, if it has one, is the issuer's
+// subject key identifier. Signatures aren't checked so precertificates, which
+// have none, match too.
+func IssuerCertFilter(issuers []*x509.Certificate) Filter {
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, issuer := range issuers {
+			if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+				continue
+			}
+			if len(cert.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 && !bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId) {
+				continue
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+// IssuerFingerprintFilter keeps entries whose leaf issuer, as found in the
+// entry's chain, has one of the given SHA-256 fingerprints. It only applies to
+// the leaf, chain certificates (whose issuer is often a root that isn't in the
+// chain) are kept.
+func IssuerFingerprintFilter(fingerprints []string) (EntryFilter, error) {
+	fps := make(map[[32]byte]struct{}, len(fingerprints))
+	for _, f := range fingerprints {
+		decoded, err := parseHex(f)
+		if err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("invalid fingerprint '%s', expected a hex encoded SHA-256 hash", f)
+		}
+		var fp [32]byte
+		copy(fp[:], decoded)
+		fps[fp] = struct{}{}
+	}
+	subjects := &subjectCache{subjects: make(map[[32]byte][]byte)}
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		if ent == nil || !isLeaf(ent.Entry, cert) {
+			return false, nil
+		}
+		for _, c := range chain(ent.Entry) {
+			fp := sha256.Sum256(c)
+			subject, err := subjects.get(fp, c)
+			if err != nil {
+				return false, err
+			}
+			if bytes.Equal(subject, cert.RawIssuer) {
+				_, present := fps[fp]
+				return !present, nil
+			}
+		}
+		// issuer isn't in the chain (a root or a broken chain)
+		return true, nil
+	}, nil
+}
+
+func isLeaf(entry *ct.Entry, cert *x509.Certificate) bool {
+	if entry.Type == ct.PreCertEntry {
+		return bytes.Equal(cert.RawTBSCertificate, entry.TBSCert)
+	}
+	return bytes.Equal(cert.Raw, entry.X509Cert)
+}
+
+// maxCachedSubjects bounds the subject cache, logs with lots of odd chains
+// would otherwise grow it forever
+var maxCachedSubjects = 10000
+
+// subjectCache keeps the subjects of chain certificates, the same few
+// intermediates appear in most entries so it's not worth parsing them every
+// time
+type subjectCache struct {
+	mu       sync.RWMutex
+	subjects map[[32]byte][]byte
+}
+
+func (sc *subjectCache) get(fp [32]byte, rawCert []byte) ([]byte, error) {
+	sc.mu.RLock()
+	subject, present := sc.subjects[fp]
+	sc.mu.RUnlock()
+	if present {
+		return subject, nil
+	}
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chain certificate: %s", err)
+	}
+	sc.mu.Lock()
+	if len(sc.subjects) >= maxCachedSubjects {
+		// start again, the common intermediates are quickly cached again
+		sc.subjects = make(map[[32]byte][]byte)
+	}
+	sc.subjects[fp] = cert.RawSubject
+	sc.mu.Unlock()
+	return cert.RawSubject, nil
+}
+
+// loadCertificates reads the PEM or DER encoded certificates in a file
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+func issuerCertFilter(args []string) (Filter, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected at least one certificate file")
+	}
+	issuers := []*x509.Certificate{}
+	for _, filename := range args {
+		certs, err := loadCertificates(strings.TrimPrefix(filename, "@"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load issuers from '%s': %s", filename, err)
+		}
+		issuers = append(issuers, certs...)
+	}
+	return IssuerCertFilter(issuers), nil
+}
@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// certNames returns the normalized DNS names and subject common name of a
+// certificate
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+1)
+	for _, n := range cert.DNSNames {
+		names = append(names, normalizeName(n))
+	}
+	if cert.Subject.CommonName != "" {
+		names = append(names, normalizeName(cert.Subject.CommonName))
+	}
+	return names
+}
+
+// loadNames reads a list of names from a file, one per line, ignoring blank
+// lines and lines starting with #
+func loadNames(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	names := []string{}
+	s := bufio.NewScanner(file)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, s.Err()
+}
+
+// expandNameArgs replaces arguments starting with @ with the names listed in
+// the file they name
+func expandNameArgs(args []string) ([]string, error) {
+	names := []string{}
+	for _, a := range args {
+		if !strings.HasPrefix(a, "@") {
+			names = append(names, a)
+			continue
+		}
+		loaded, err := loadNames(a[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load names from '%s': %s", a[1:], err)
+		}
+		names = append(names, loaded...)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("expected at least one name")
+	}
+	return names, nil
+}
+
+func nameSet(names []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[normalizeName(n)] = struct{}{}
+	}
+	return set
+}
+
+// NameFilter keeps certificates with a DNS name or common name in names
+func NameFilter(names []string) Filter {
+	set := nameSet(names)
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, n := range certNames(cert) {
+			if _, present := set[n]; present {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// NameSuffixFilter keeps certificates with a name that is, or is a subdomain
+// of, one of suffixes
+func NameSuffixFilter(suffixes []string) Filter {
+	set := nameSet(suffixes)
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, n := range certNames(cert) {
+			for {
+				if _, present := set[n]; present {
+					return false, nil
+				}
+				i := strings.Index(n, ".")
+				if i < 0 {
+					break
+				}
+				n = n[i+1:]
+			}
+		}
+		return true, nil
+	}
+}
+
+// DomainFilter keeps certificates with a name whose registrable domain
+// (eTLD+1) is one of domains
+func DomainFilter(domains []string) Filter {
+	set := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		d = normalizeName(d)
+		if registrable, err := publicsuffix.EffectiveTLDPlusOne(d); err == nil {
+			d = registrable
+		}
+		set[d] = struct{}{}
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, n := range certNames(cert) {
+			registrable, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(n, "*."))
+			if err != nil {
+				continue
+			}
+			if _, present := set[registrable]; present {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+}
+
+// NameRegexFilter keeps certificates with a name matching one of patterns
+func NameRegexFilter(patterns []string) (Filter, error) {
+	res := make([]*regexp.Regexp, len(patterns))
+	for i, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = re
+	}
+	return func(cert *x509.Certificate) (bool, error) {
+		for _, n := range certNames(cert) {
+			for _, re := range res {
+				if re.MatchString(n) {
+					return false, nil
+				}
+			}
+		}
+		return true, nil
+	}, nil
+}
+
+func nameListFilter(constructor func([]string) Filter) func([]string) (Filter, error) {
+	return func(args []string) (Filter, error) {
+		names, err := expandNameArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return constructor(names), nil
+	}
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+// leafFingerprint is the SHA-256 fingerprint of the certificate an entry was
+// logged for, the TBS is used for precertificate entries
+func leafFingerprint(entry *ct.Entry) [32]byte {
+	if entry.Type == ct.PreCertEntry {
+		return sha256.Sum256(entry.TBSCert)
+	}
+	return sha256.Sum256(entry.X509Cert)
+}
+
+// SampleFilter keeps roughly rate (0-1) of entries. Whether an entry is kept
+// only depends on the seed and its leaf fingerprint so the same seed picks
+// the same sample every time, and all the certificates from an entry (its
+// chain included) are kept or skipped together. Certificates that didn't come
+// from an entry are sampled using their own fingerprint.
+func SampleFilter(rate float64, seed string) (EntryFilter, error) {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1")
+	}
+	if rate == 1 {
+		return func(*ct.EntryAndPosition, *x509.Certificate) (bool, error) {
+			return false, nil
+		}, nil
+	}
+	// keep hashes below rate * 2^64
+	threshold := uint64(rate * math.Exp2(64))
+	return func(ent *ct.EntryAndPosition, cert *x509.Certificate) (bool, error) {
+		var fp [32]byte
+		if ent != nil {
+			fp = leafFingerprint(ent.Entry)
+		} else {
+			fp = sha256.Sum256(cert.Raw)
+		}
+		// the separator keeps the seed from running into the fingerprint
+		h := sha256.Sum256(append(append([]byte(seed), 0), fp[:]...))
+		return binary.BigEndian.Uint64(h[:8]) >= threshold, nil
+	}, nil
+}
+
+func sampleFilter(args []string) (EntryFilter, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, fmt.Errorf("expected a rate and optional seed")
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sample rate '%s'", args[0])
+	}
+	seed := ""
+	if len(args) == 2 {
+		seed = args[1]
+	}
+	return SampleFilter(rate, seed)
+}
@@ -0,0 +1,68 @@
+package filter
+
+import (
+	"crypto/x509"
+	"fmt"
+	"reflect"
+	"testing"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+)
+
+func sampleEntries() []*ct.EntryAndPosition {
+	entries := []*ct.EntryAndPosition{}
+	for i := 0; i < 20; i++ {
+		entries = append(entries, &ct.EntryAndPosition{
+			Index: uint64(i),
+			Entry: &ct.Entry{Type: ct.X509Entry, X509Cert: []byte(fmt.Sprintf("certificate %d", i))},
+		})
+	}
+	return entries
+}
+
+func sampled(t *testing.T, f EntryFilter, entries []*ct.EntryAndPosition) []uint64 {
+	kept := []uint64{}
+	for _, ent := range entries {
+		skip, err := f(ent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !skip {
+			kept = append(kept, ent.Index)
+		}
+	}
+	return kept
+}
+
+// TestSample pins the sample picked for a seed, changing how entries are
+// hashed changes which certificates every existing seed picks
+func TestSample(t *testing.T) {
+	entries := sampleEntries()
+	f, err := SampleFilter(0.25, "seed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint64{1, 5, 8, 12, 15, 16}
+	if kept := sampled(t, f, entries); !reflect.DeepEqual(kept, expected) {
+		t.Fatalf("sample(0.25, seed) kept %v, expected %v", kept, expected)
+	}
+
+	// certificates that didn't come from an entry are sampled the same way
+	for _, ent := range entries {
+		entrySkip, _ := f(ent, nil)
+		certSkip, _ := f(nil, &x509.Certificate{Raw: ent.Entry.X509Cert})
+		if entrySkip != certSkip {
+			t.Fatalf("entry %d and its certificate were sampled differently", ent.Index)
+		}
+	}
+
+	for rate, expected := range map[float64]int{0: 0, 1: len(entries)} {
+		f, err := SampleFilter(rate, "seed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept := sampled(t, f, entries); len(kept) != expected {
+			t.Fatalf("sample(%g) kept %d of %d entries", rate, len(kept), len(entries))
+		}
+	}
+}
@@ -221,15 +221,20 @@ func (g IssuerGraph) removeRevokedNodes() {
 }
 
 type builder struct {
-	filters []filter.Filter
+	filters []filter.EntryFilter
 
 	pMu       *sync.Mutex
 	processed map[[32]byte]struct{}
+	// CA certificates the filters skipped, entry filters may keep them when
+	// they turn up in another entry and they turn up a lot so it's worth
+	// keeping them parsed
+	skipped map[[32]byte]*x509.Certificate
 
 	gMu   *sync.Mutex
 	graph IssuerGraph
 
-	verbose bool
+	verbose         bool
+	includePrecerts bool
 }
 
 func (b *builder) addAnchorsFromFile(anchorsFile string) {
@@ -245,7 +250,7 @@ func (b *builder) addAnchorsFromFile(anchorsFile string) {
 		if block == nil || len(block.Bytes) == 0 {
 			break
 		}
-		if n := b.addNode(block.Bytes); n != nil {
+		if n := b.addNode(nil, block.Bytes); n != nil {
 			n.InitialRootNode = true
 		}
 		data = r
@@ -280,33 +285,100 @@ func (b *builder) addAnchorsFromLog(logURI string) {
 		if err != nil {
 			continue
 		}
-		if n := b.addNode(rawCert); n != nil {
+		if n := b.addNode(nil, rawCert); n != nil {
 			n.InitialRootNode = true
 		}
 	}
 	fmt.Printf("[added %d nodes]\n", len(b.graph)-startingCount)
 }
 
-func (b *builder) addNode(rawCert []byte) *node {
-	certFP := sha256.Sum256(rawCert)
+func (b *builder) firstSeen(fp [32]byte) bool {
 	b.pMu.Lock()
-	if _, alreadyDone := b.processed[certFP]; alreadyDone {
-		b.pMu.Unlock()
-		return nil
+	defer b.pMu.Unlock()
+	if _, alreadyDone := b.processed[fp]; alreadyDone {
+		return false
 	}
-	b.processed[certFP] = struct{}{}
-	b.pMu.Unlock()
+	b.processed[fp] = struct{}{}
+	return true
+}
 
-	cert, skip, err := common.ParseAndFilter(rawCert, b.filters)
-	if skip || err != nil {
+// seen returns true if a certificate has already been processed, otherwise
+// it returns the parsed certificate if it was skipped before
+func (b *builder) seen(fp [32]byte) (bool, *x509.Certificate) {
+	b.pMu.Lock()
+	defer b.pMu.Unlock()
+	if _, alreadyDone := b.processed[fp]; alreadyDone {
+		return true, nil
+	}
+	return false, b.skipped[fp]
+}
+
+func (b *builder) skip(fp [32]byte, cert *x509.Certificate) {
+	b.pMu.Lock()
+	defer b.pMu.Unlock()
+	b.skipped[fp] = cert
+}
+
+// addNode adds a certificate, ent is the entry it came from or nil for trust
+// anchors
+func (b *builder) addNode(ent *ct.EntryAndPosition, rawCert []byte) *node {
+	fp := sha256.Sum256(rawCert)
+	done, cert := b.seen(fp)
+	if done {
+		return nil
+	}
+	if cert == nil {
+		var err error
+		cert, err = x509.ParseCertificate(rawCert)
 		if err != nil {
+			b.firstSeen(fp)
 			if b.verbose {
-				fmt.Fprintf(os.Stderr, "error while filtering entries: %s\n", err)
+				fmt.Fprintf(os.Stderr, "error while parsing certificate: %s\n", err)
 			}
+			return nil
+		}
+	}
+	if common.IsPrecert(cert) {
+		// precertificates in chains are counted using the TBS from the
+		// entry itself
+		b.firstSeen(fp)
+		return nil
+	}
+	_, skip, err := common.RunFilters(ent, cert, b.filters)
+	if skip || err != nil {
+		if err != nil && b.verbose {
+			fmt.Fprintf(os.Stderr, "error while filtering entries: %s\n", err)
+		}
+		if skip && cert.IsCA {
+			b.skip(fp, cert)
+		}
+		return nil
+	}
+	if !b.firstSeen(fp) {
+		return nil
+	}
+	return b.addCert(cert)
+}
+
+func (b *builder) addPrecert(ent *ct.EntryAndPosition) *node {
+	fp := sha256.Sum256(ent.Entry.TBSCert)
+	if done, _ := b.seen(fp); done {
+		return nil
+	}
+	cert, skip, err := common.ParseEntryAndFilter(ent, b.filters, true, nil)
+	if skip || err != nil {
+		if err != nil && b.verbose {
+			fmt.Fprintf(os.Stderr, "error while filtering entries: %s\n", err)
 		}
 		return nil
 	}
+	if !b.firstSeen(fp) {
+		return nil
+	}
+	return b.addCert(cert)
+}
 
+func (b *builder) addCert(cert *x509.Certificate) *node {
 	issuer := common.SubjectToString(cert.Issuer)
 	if issuer == "???" {
 		// idk when this would happen but... w/e
@@ -344,35 +416,49 @@ func (b *builder) addNode(rawCert []byte) *node {
 	return i
 }
 
-func (b *builder) createNodesFromCT(entries *ct.EntriesFile) {
+func (b *builder) createNodesFromCT(entries *common.CacheFile) error {
 	started := time.Now()
 	startingCount := len(b.graph)
 	fmt.Println("adding nodes from CT cache file...")
-	entries.Map(func(ent *ct.EntryAndPosition, err error) {
+	err := entries.Map(func(ent *ct.EntryAndPosition, err error) {
 		if err != nil {
 			if b.verbose {
 				fmt.Fprintf(os.Stderr, "error parsing ct entry: %s\n", err)
 			}
 			return
 		}
-		if ent.Entry.Type != ct.X509Entry {
-			return
-		}
-		for _, extraCert := range ent.Entry.ExtraCerts {
-			b.addNode(extraCert)
+		switch ent.Entry.Type {
+		case ct.X509Entry:
+			for _, extraCert := range ent.Entry.ExtraCerts {
+				b.addNode(ent, extraCert)
+			}
+			b.addNode(ent, ent.Entry.X509Cert)
+		case ct.PreCertEntry:
+			if !b.includePrecerts {
+				return
+			}
+			for _, extraCert := range ent.Entry.ExtraCerts {
+				b.addNode(ent, extraCert)
+			}
+			b.addPrecert(ent)
 		}
-		b.addNode(ent.Entry.X509Cert)
 	})
+	if err != nil {
+		return err
+	}
 	fmt.Printf("[added %d nodes]\ntook %s\n", len(b.graph)-startingCount, time.Since(started))
+	return nil
 }
 
-func Build(rootsFile, rootsURI, cacheFile, graphFile, filters string, verbose bool) error {
+func Build(rootsFile, rootsURI, cacheFile, graphFile, filters string, verbose, includePrecerts bool) error {
 	b := builder{
-		verbose:   verbose,
-		gMu:       new(sync.Mutex),
-		pMu:       new(sync.Mutex),
-		graph:     make(map[string]*node),
-		processed: make(map[[32]byte]struct{}),
+		verbose:         verbose,
+		includePrecerts: includePrecerts,
+		gMu:             new(sync.Mutex),
+		pMu:             new(sync.Mutex),
+		graph:           make(map[string]*node),
+		processed:       make(map[[32]byte]struct{}),
+		skipped:         make(map[[32]byte]*x509.Certificate),
 	}
 	if filters != "" {
 		var err error
@@ -393,7 +479,9 @@ func Build(rootsFile, rootsURI, cacheFile, graphFile, filters string, verbose bo
 		return err
 	}
 	defer entries.Close()
-	b.createNodesFromCT(entries)
+	if err = b.createNodesFromCT(entries); err != nil {
+		return err
+	}
 	data, err := json.Marshal(b.graph)
 	if err != nil {
 		return err
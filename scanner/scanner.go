@@ -1,7 +1,7 @@
 package main
 
 import (
-	// "bytes"
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
@@ -18,6 +18,9 @@ import (
 	"text/tabwriter"
 	"time"
 
+	"github.com/rolandshoemaker/ctat/common"
+	"github.com/rolandshoemaker/ctat/filter"
+
 	ct "github.com/rolandshoemaker/certificatetransparency"
 	"golang.org/x/crypto/ocsp"
 )
@@ -66,11 +69,14 @@ type collectedResults struct {
 
 	chMu       *sync.Mutex
 	CipherHist map[string]int64
+
+	Drops *common.Drops
 }
 
 type workUnit struct {
-	cert *x509.Certificate
-	ocsp *ocsp.Response
+	cert    *x509.Certificate
+	ocsp    *ocsp.Response
+	precert bool
 }
 
 type tester struct {
@@ -86,6 +92,12 @@ type tester struct {
 	entries       chan *workUnit
 	dialerTimeout time.Duration
 
+	includePrecerts bool
+	filters         []filter.EntryFilter
+	filterNames     []string
+	sampleRate      float64
+	sampleSeed      string
+
 	// misc
 	debug bool
 }
@@ -255,6 +267,8 @@ func (t *tester) printStats() {
 	}
 	fmt.Fprintln(w)
 	w.Flush()
+
+	t.results.Drops.Print(os.Stdout)
 }
 
 func (t *tester) saveStats(filename string) error {
@@ -275,7 +289,7 @@ func (t *tester) saveStats(filename string) error {
 	return err
 }
 
-func (t *tester) checkName(dnsName string, expectedFP [32]byte) (r result) {
+func (t *tester) checkName(dnsName string, isExpected func(*x509.Certificate) bool) (r result) {
 	defer atomic.AddInt64(&t.results.ProcessedNames, 1)
 	// XXX: dialer/TLS config should accept all cipher suites (possibly in some weird order?) so
 	// we catch everything
@@ -332,7 +346,7 @@ func (t *tester) checkName(dnsName string, expectedFP [32]byte) (r result) {
 		return
 	}
 	for _, peer := range state.PeerCertificates {
-		if sha256.Sum256(peer.Raw) == expectedFP {
+		if isExpected(peer) {
 			r.certUsed = true
 			break
 		}
@@ -347,12 +361,22 @@ func (t *tester) checkName(dnsName string, expectedFP [32]byte) (r result) {
 	return
 }
 
-func (t *tester) checkCert(cert *x509.Certificate) {
+func (t *tester) checkCert(wu *workUnit) {
 	defer atomic.AddInt64(&t.results.ProcessedCerts, 1)
-	fp := sha256.Sum256(cert.Raw)
+	fp := sha256.Sum256(wu.cert.Raw)
+	isExpected := func(peer *x509.Certificate) bool {
+		return sha256.Sum256(peer.Raw) == fp
+	}
+	if wu.precert {
+		// the final certificate has the same issuer and serial as the
+		// precertificate but not the same bytes
+		isExpected = func(peer *x509.Certificate) bool {
+			return peer.SerialNumber.Cmp(wu.cert.SerialNumber) == 0 && bytes.Equal(peer.RawIssuer, wu.cert.RawIssuer)
+		}
+	}
 	var results []result
-	for _, name := range cert.DNSNames {
-		results = append(results, t.checkName(name, fp))
+	for _, name := range wu.cert.DNSNames {
+		results = append(results, t.checkName(name, isExpected))
 	}
 	t.processResults(results)
 }
@@ -377,7 +401,7 @@ func (t *tester) run() {
 				case <-stop:
 					return
 				default:
-					t.checkCert(te.cert)
+					t.checkCert(te)
 				}
 			}
 		}()
@@ -399,54 +423,49 @@ func (t *tester) run() {
 	fmt.Printf("\n\nscan finished, took %s\n", t.results.Finished.Sub(t.results.Started))
 }
 
-func basicFilter(issuerFilter string, checkOCSP bool, ent *ct.EntryAndPosition, err error) (*x509.Certificate, *ocsp.Response) {
+func basicFilter(drops *common.Drops, filters []filter.EntryFilter, checkOCSP, includePrecerts bool, ent *ct.EntryAndPosition, err error) *workUnit {
 	if err != nil {
-		return nil, nil
+		drops.EntryError()
+		return nil
 	}
-	cert, err := x509.ParseCertificate(ent.Entry.X509Cert)
-	if err != nil {
-		return nil, nil
-	}
-	if cert.Issuer.CommonName != issuerFilter {
-		return nil, nil
-	}
-	if time.Now().After(cert.NotAfter) {
-		return nil, nil
+	cert, skip, err := common.ParseEntryAndFilter(ent, filters, includePrecerts, drops)
+	if skip || err != nil {
+		return nil
 	}
 	var ocspResp *ocsp.Response
 	if checkOCSP {
 		// do something
 	}
-	return cert, ocspResp
+	return &workUnit{cert: cert, ocsp: ocspResp, precert: ent.Entry.Type == ct.PreCertEntry}
 }
 
-func (t *tester) filterOnIssuer(issuerFilter string) func(*ct.EntryAndPosition, error) {
+func (t *tester) filterOnIssuer() func(*ct.EntryAndPosition, error) {
 	return func(ent *ct.EntryAndPosition, err error) {
-		if cert, ocspResp := basicFilter(issuerFilter, false, ent, err); cert != nil {
-			atomic.AddInt64(&t.totalNames, int64(len(cert.DNSNames)))
-			t.entries <- &workUnit{cert: cert, ocsp: ocspResp}
+		if wu := basicFilter(t.results.Drops, t.filters, false, t.includePrecerts, ent, err); wu != nil {
+			atomic.AddInt64(&t.totalNames, int64(len(wu.cert.DNSNames)))
+			t.entries <- wu
 		}
 	}
 }
 
-func (t *tester) filterOnIssuerAndDedup(issuerFilter string) (func(*ct.EntryAndPosition, error), func()) {
+func (t *tester) filterOnIssuerAndDedup() (func(*ct.EntryAndPosition, error), func()) {
 	ddMap := make(map[string]*workUnit)
 	ddMu := new(sync.Mutex)
 	return func(ent *ct.EntryAndPosition, err error) {
-			cert, ocspResp := basicFilter(issuerFilter, false, ent, err)
-			if cert == nil {
+			wu := basicFilter(t.results.Drops, t.filters, false, t.includePrecerts, ent, err)
+			if wu == nil {
 				return
 			}
-			names := cert.DNSNames
+			names := wu.cert.DNSNames
 			sort.Strings(names)
 			sortedNames := strings.Join(names, ",")
 			ddMu.Lock()
 			if oldCert, present := ddMap[sortedNames]; present {
-				if cert.NotAfter.After(oldCert.cert.NotAfter) {
-					ddMap[sortedNames] = &workUnit{cert: cert, ocsp: ocspResp}
+				if wu.cert.NotAfter.After(oldCert.cert.NotAfter) {
+					ddMap[sortedNames] = wu
 				}
 			} else {
-				ddMap[sortedNames] = &workUnit{cert: cert, ocsp: ocspResp}
+				ddMap[sortedNames] = wu
 			}
 			ddMu.Unlock()
 		}, func() {
@@ -459,45 +478,80 @@ func (t *tester) filterOnIssuerAndDedup(issuerFilter string) (func(*ct.EntryAndP
 		}
 }
 
-func (t *tester) filterOnIssuerAndSample(issuerFilter string) func(*ct.EntryAndPosition, error) {
-	return nil
+func (t *tester) filterOnIssuerAndSample() (func(*ct.EntryAndPosition, error), error) {
+	sampler, err := filter.SampleFilter(t.sampleRate, t.sampleSeed)
+	if err != nil {
+		return nil, err
+	}
+	// sample first, it's the cheapest filter
+	t.filters = append([]filter.EntryFilter{sampler}, t.filters...)
+	t.filterNames = append([]string{fmt.Sprintf("sample(%g)", t.sampleRate)}, t.filterNames...)
+	return t.filterOnIssuer(), nil
 }
 
 func (t *tester) loadAndFilter(filename string, filterFunc func(*ct.EntryAndPosition, error)) error {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	entriesFile, err := common.LoadCacheFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	entriesFile := ct.EntriesFile{file}
+	defer entriesFile.Close()
 
-	count, err := entriesFile.Count()
+	count, err := common.CountEntries(entriesFile.EntriesFile, filename)
 	if err != nil {
 		return err
 	}
-	entriesFile.Seek(0, 0)
 
 	fmt.Println("filtering local cache")
 	t.entries = make(chan *workUnit, count)
-	entriesFile.Map(filterFunc)
-	return nil
+	t.results.Drops = common.NewDrops(t.filterNames)
+	return entriesFile.Map(filterFunc)
 }
 
 func main() {
 	filename := flag.String("cacheFile", "certly.log", "file in which to cache log data.")
-	issuerFilter := flag.String("issuerFilter", "Let's Encrypt Authority X1", "common name of issuer to use as a filter")
+	issuerFilter := flag.String("issuerFilter", "Let's Encrypt Authority X1", "common name of issuer to use as a filter (empty to match any issuer, use -filters for richer issuer matching)")
 	scanners := flag.Int("scanners", 50, "number of scanner workers to run")
 	debug := flag.Bool("debug", false, "print lots of error messages")
 	dontPrintProgress := flag.Bool("dontPrintProgress", false, "don't print progress information")
 	scannerTimeout := flag.Duration("scannerTimeout", time.Second*5, "dialer timeout for the tls scanners (uses golang duration format, e.g. 5s)")
-	filter := flag.String("filter", "issuer", "how to filter the CT cache")
+	filterType := flag.String("filter", "issuer", "how to filter the CT cache (issuer, issuerDeduped, or issuerSampled)")
 	statsFile := flag.String("statsFile", "", "file to save scan stats out to (subsequent runs will append to the end of the file)")
+	includePrecerts := flag.Bool("includePrecerts", false, "also scan names from precertificate entries")
+	filters := flag.String("filters", "", "filter expression certificates must also match, e.g. 'not issuerCN(\"X\")'")
+	sampleRate := flag.Float64("sampleRate", 0.01, "fraction of certificates to scan when using the issuerSampled filter")
+	sampleSeed := flag.String("sampleSeed", "", "seed used to pick the sample, the same seed always picks the same certificates")
+	asOf := flag.String("asOf", "", "reference time for time dependent filters like 'unexpired' (YYYY-MM-DD or RFC 3339), defaults to now")
 	flag.Parse()
 
-	if *filter != "issuer" && *filter != "issuerDeduped" {
+	if *filterType != "issuer" && *filterType != "issuerDeduped" && *filterType != "issuerSampled" {
 		fmt.Fprintf(os.Stderr, "incorrect filter type\n")
 		os.Exit(1)
 	}
+	if *asOf != "" {
+		t, err := filter.ParseTime(*asOf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -asOf: %s\n", err)
+			os.Exit(1)
+		}
+		filter.SetAsOf(t)
+	}
+	var entryFilters []filter.EntryFilter
+	var filterNames []string
+	if *issuerFilter != "" {
+		entryFilters = append(entryFilters, filter.Entry(filter.IssuerCNFilter(*issuerFilter)))
+		filterNames = append(filterNames, "-issuerFilter")
+	}
+	entryFilters = append(entryFilters, filter.Entry(filter.UnexpiredFilter))
+	filterNames = append(filterNames, "unexpired")
+	if *filters != "" {
+		extraFilters, extraNames, err := filter.StringToNamedFilters(*filters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid filter expression: %s\n", err)
+			os.Exit(1)
+		}
+		entryFilters = append(entryFilters, extraFilters...)
+		filterNames = append(filterNames, extraNames...)
+	}
 
 	t := tester{
 		workers:           *scanners,
@@ -505,30 +559,47 @@ func main() {
 		debug:             *debug,
 		dontPrintProgress: *dontPrintProgress,
 		dialerTimeout:     *scannerTimeout,
+		includePrecerts:   *includePrecerts,
+		filters:           entryFilters,
+		filterNames:       filterNames,
+		sampleRate:        *sampleRate,
+		sampleSeed:        *sampleSeed,
 		results: collectedResults{
 			chMu:       new(sync.Mutex),
 			CipherHist: make(map[string]int64),
 		},
 	}
 
-	switch *filter {
+	switch *filterType {
 	case "issuer":
-		err := t.loadAndFilter(*filename, t.filterOnIssuer(*issuerFilter))
+		err := t.loadAndFilter(*filename, t.filterOnIssuer())
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to load, update, and filter the local CT cache file: %s\n", err)
 			os.Exit(1)
 		}
 	case "issuerDeduped":
-		filterFunc, dedup := t.filterOnIssuerAndDedup(*issuerFilter)
+		filterFunc, dedup := t.filterOnIssuerAndDedup()
 		err := t.loadAndFilter(*filename, filterFunc)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to load, update, and filter the local CT cache file: %s\n", err)
 			os.Exit(1)
 		}
 		dedup()
+	case "issuerSampled":
+		filterFunc, err := t.filterOnIssuerAndSample()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -sampleRate: %s\n", err)
+			os.Exit(1)
+		}
+		err = t.loadAndFilter(*filename, filterFunc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load, update, and filter the local CT cache file: %s\n", err)
+			os.Exit(1)
+		}
 	}
 	if len(t.entries) == 0 {
 		fmt.Fprintf(os.Stderr, "filtered list contains no certificates!\n")
+		t.results.Drops.Print(os.Stderr)
 		os.Exit(1)
 	}
 	close(t.entries)
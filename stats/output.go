@@ -0,0 +1,228 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/rolandshoemaker/ctat/common"
+)
+
+// Formats lists the formats Analyse can write results in, state is the
+// accumulated state of each metric which MergeStates can combine
+var Formats = []string{"text", "json", "csv", "state"}
+
+// ValidFormat checks format is one of Formats
+func ValidFormat(format string) bool {
+	for _, f := range Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// analysis is everything collected by Analyse or merged by MergeStates,
+// ctErrors and x509Errors are nil unless errors were measured
+type analysis struct {
+	metrics    []metric
+	drops      *common.Drops
+	ctErrors   strMap
+	x509Errors strMap
+}
+
+func (a *analysis) write(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		return a.print(w)
+	case "state":
+		ss, err := a.state()
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(w).Encode(ss)
+	}
+	results := jsonHolder{Timestamp: time.Now(), Drops: a.drops}
+	for _, m := range a.metrics {
+		d := m.generator.json()
+		d.Name = m.name
+		results.Stats = append(results.Stats, d)
+	}
+	if a.ctErrors != nil {
+		ctDatum := strDistDatum("Error", a.ctErrors, 0)
+		ctDatum.Name = "ctErrors"
+		x509Datum := strDistDatum("Error", a.x509Errors, 0)
+		x509Datum.Name = "x509Errors"
+		results.Stats = append(results.Stats, ctDatum, x509Datum)
+	}
+	switch format {
+	case "json":
+		return json.NewEncoder(w).Encode(results)
+	case "csv":
+		return writeCSV(w, results)
+	}
+	return fmt.Errorf("unknown output format '%s'", format)
+}
+
+// errWriter keeps the first error from writing to w so the text output, which
+// is written by a lot of Fprintf calls, can be checked once at the end
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.w.Write(p)
+	ew.err = err
+	return n, err
+}
+
+func (a *analysis) print(out io.Writer) error {
+	w := &errWriter{w: out}
+	for _, m := range a.metrics {
+		m.generator.print(w)
+		fmt.Fprintln(w)
+	}
+
+	a.drops.Print(w)
+
+	if a.ctErrors != nil {
+		ctErrorDist, ctSum := mapToStrDist(a.ctErrors, 0)
+		x509ErrorsDist, x509Sum := mapToStrDist(a.x509Errors, 0)
+		fmt.Fprintf(w, "\n# CT parsing errors\n")
+		ctErrorDist.print(w, "Error", ctSum)
+		fmt.Fprintln(w, "# x509 parsing errors")
+		x509ErrorsDist.print(w, "Error", x509Sum)
+	}
+	return w.err
+}
+
+// writeCSV flattens results into one row per statistic or distribution
+// bucket, distribution is only set for metrics with more than one
+// distribution and value is empty for statistics. Each split used by a metric
+// gets a column (before distribution) holding the key a row belongs to.
+func writeCSV(w io.Writer, results jsonHolder) error {
+	var splits []string
+	for _, d := range results.Stats {
+		splits = datumSplits(d, splits)
+	}
+	cw := csv.NewWriter(w)
+	header := append(append([]string{"metric"}, splits...), "distribution", "label", "value", "count")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, d := range results.Stats {
+		for _, row := range datumRows(d, splits, nil) {
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	if results.Drops != nil {
+		drop := func(distribution, label string, count int64) []string {
+			return csvRow("drops", splits, nil, distribution, label, "", strconv.FormatInt(count, 10))
+		}
+		rows := [][]string{
+			drop("", "Entries", results.Drops.Entries),
+			drop("", "Kept", results.Drops.Kept),
+			drop("", "Unparseable CT entries", results.Drops.EntryErrors),
+			drop("", "Unparseable certificates", results.Drops.CertErrors),
+			drop("", "Filter errors", results.Drops.FilterErrors),
+			drop("", "Skipped precertificates", results.Drops.Precerts),
+		}
+		for _, f := range results.Drops.Filtered {
+			rows = append(rows, drop("filtered", f.Filter, f.Dropped))
+		}
+		if err := cw.WriteAll(rows); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// datumSplits adds any splits used by d that aren't already in splits
+func datumSplits(d jsonDatum, splits []string) []string {
+	holder, ok := d.Data.(seriesHolder)
+	if !ok {
+		return splits
+	}
+	found := false
+	for _, s := range splits {
+		if s == holder.Split {
+			found = true
+			break
+		}
+	}
+	if !found {
+		splits = append(splits, holder.Split)
+	}
+	for _, p := range holder.Parts {
+		splits = datumSplits(p.Datum, splits)
+	}
+	return splits
+}
+
+func csvRow(name string, splits []string, keys map[string]string, fields ...string) []string {
+	row := []string{name}
+	for _, s := range splits {
+		row = append(row, keys[s])
+	}
+	return append(row, fields...)
+}
+
+func datumRows(d jsonDatum, splits []string, keys map[string]string) [][]string {
+	rows := [][]string{}
+	switch data := d.Data.(type) {
+	case statHolder:
+		rows = append(rows, csvRow(d.Name, splits, keys, "", data.Label, "", strconv.Itoa(data.Value)))
+	case []statHolder:
+		for _, stat := range data {
+			rows = append(rows, csvRow(d.Name, splits, keys, "", stat.Label, "", strconv.Itoa(stat.Value)))
+		}
+	case distHolder:
+		rows = append(rows, distRows(d.Name, splits, keys, data)...)
+	case []distHolder:
+		for _, dist := range data {
+			rows = append(rows, distRows(d.Name, splits, keys, dist)...)
+		}
+	case resultHolder:
+		for _, stat := range data.Stats {
+			rows = append(rows, csvRow(d.Name, splits, keys, "", stat.Label, "", strconv.Itoa(stat.Value)))
+		}
+		for _, dist := range data.Dists {
+			rows = append(rows, distRows(d.Name, splits, keys, dist)...)
+		}
+	case seriesHolder:
+		for _, p := range data.Parts {
+			partKeys := map[string]string{data.Split: p.Key}
+			for k, v := range keys {
+				partKeys[k] = v
+			}
+			p.Datum.Name = d.Name
+			rows = append(rows, datumRows(p.Datum, splits, partKeys)...)
+		}
+	}
+	return rows
+}
+
+func distRows(name string, splits []string, keys map[string]string, dist distHolder) [][]string {
+	rows := [][]string{}
+	switch buckets := dist.Dist.(type) {
+	case intDistribution:
+		for _, b := range buckets {
+			rows = append(rows, csvRow(name, splits, keys, dist.Name, dist.Label, strconv.Itoa(b.Value), strconv.Itoa(b.Frequency)))
+		}
+	case strDistribution:
+		for _, b := range buckets {
+			rows = append(rows, csvRow(name, splits, keys, dist.Name, dist.Label, b.Value, strconv.Itoa(b.Frequency)))
+		}
+	}
+	return rows
+}
@@ -0,0 +1,113 @@
+package stats
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// Metric is a metric generator that can be added to analyse with Register.
+// Process is called concurrently with every certificate that passes the
+// filters, Result reports what has been collected so far, and Merge adds a
+// Result from another run (analyse merge saves and combines Results, so they
+// should hold counts rather than percentages).
+type Metric interface {
+	Process(*x509.Certificate)
+	Result() Result
+	Merge(Result) error
+}
+
+// Result is what a Metric reports, a title for text output and any number of
+// single values and distributions
+type Result struct {
+	Title string
+	Stats []Stat
+	Dists []Dist
+}
+
+type Stat struct {
+	Label string
+	Value int
+}
+
+// Dist is a distribution of values, Label describes the values and Name tells
+// distributions apart when a Result has more than one
+type Dist struct {
+	Name   string
+	Label  string
+	Counts map[string]int
+}
+
+// Register adds a metric that can be selected by name with --leafMetrics,
+// factory is called for every run (and every group or time bucket). It is
+// meant to be called from the init function of a package imported by the
+// ctat binary and panics if name is already taken.
+func Register(name string, factory func() Metric) {
+	if _, present := metricsLookup[name]; present {
+		panic(fmt.Sprintf("stats: metric '%s' is already registered", name))
+	}
+	metricsLookup[name] = func() metricGenerator {
+		return &registeredMetric{m: factory()}
+	}
+}
+
+type resultHolder struct {
+	Stats []statHolder
+	Dists []distHolder
+}
+
+// registeredMetric adapts a Metric to a metricGenerator
+type registeredMetric struct {
+	m Metric
+}
+
+func (rm *registeredMetric) process(cert *x509.Certificate) {
+	rm.m.Process(cert)
+}
+
+func (rm *registeredMetric) print(w io.Writer) {
+	r := rm.m.Result()
+	fmt.Fprintf(w, "# %s\n", r.Title)
+	if len(r.Stats) > 0 {
+		tw := new(tabwriter.Writer)
+		tw.Init(w, 0, 8, 2, ' ', 0)
+		for _, s := range r.Stats {
+			fmt.Fprintf(tw, "%s\t%d\n", s.Label, s.Value)
+		}
+		tw.Flush()
+	}
+	for _, d := range r.Dists {
+		if d.Name != "" {
+			fmt.Fprintf(w, "## %s\n", d.Name)
+		}
+		dist, sum := mapToStrDist(d.Counts, 0)
+		dist.print(w, d.Label, sum)
+	}
+}
+
+func (rm *registeredMetric) json() jsonDatum {
+	r := rm.m.Result()
+	holder := resultHolder{Stats: []statHolder{}, Dists: []distHolder{}}
+	for _, s := range r.Stats {
+		holder.Stats = append(holder.Stats, statHolder{Value: s.Value, Label: s.Label})
+	}
+	for _, d := range r.Dists {
+		dist, _ := mapToStrDist(d.Counts, 0)
+		holder.Dists = append(holder.Dists, distHolder{Name: d.Name, Dist: dist, Label: d.Label})
+	}
+	return jsonDatum{Type: metricResult, Data: holder}
+}
+
+func (rm *registeredMetric) state() interface{} {
+	return rm.m.Result()
+}
+
+func (rm *registeredMetric) merge(state json.RawMessage) error {
+	var other Result
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	return rm.m.Merge(other)
+}
@@ -0,0 +1,212 @@
+package stats
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rolandshoemaker/ctat/common"
+	"github.com/rolandshoemaker/ctat/filter"
+
+	ct "github.com/rolandshoemaker/certificatetransparency"
+	"golang.org/x/net/publicsuffix"
+)
+
+// splitKey finds which part of a series an entry belongs to
+type splitKey func(*ct.EntryAndPosition, *x509.Certificate) string
+
+var timeBuckets = map[string]func(time.Time) string{
+	"month": func(t time.Time) string { return t.Format("2006-01") },
+	// weeks are named by the Monday they start on
+	"week": func(t time.Time) string { return t.AddDate(0, 0, -(int(t.Weekday())+6)%7).Format("2006-01-02") },
+	"day":  func(t time.Time) string { return t.Format("2006-01-02") },
+}
+
+// groupKeys are the certificate properties a metric can be grouped by
+var groupKeys = map[string]func(*x509.Certificate) string{
+	"issuer": func(cert *x509.Certificate) string { return common.SubjectToString(cert.Issuer) },
+	"issuerOrg": func(cert *x509.Certificate) string {
+		return strings.Join(cert.Issuer.Organization, ", ")
+	},
+	"keyType": filter.KeyType,
+	"sigAlg":  func(cert *x509.Certificate) string { return filter.SigAlgToString[cert.SignatureAlgorithm] },
+	// certificates are grouped by the eTLD+1 of their common name, or of their
+	// first DNS name that has one
+	"etld1": func(cert *x509.Certificate) string {
+		for _, n := range append([]string{cert.Subject.CommonName}, cert.DNSNames...) {
+			if suffix, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(n, "*.")); err == nil {
+				return strings.ToLower(suffix)
+			}
+		}
+		return ""
+	},
+}
+
+// GroupSplit returns the split for grouping by a certificate property, one of
+// issuer, issuerOrg, keyType, sigAlg, or etld1
+func GroupSplit(group string) (string, error) {
+	if _, present := groupKeys[group]; !present {
+		return "", fmt.Errorf("unknown group '%s', expected issuer, issuerOrg, keyType, sigAlg, or etld1", group)
+	}
+	return group, nil
+}
+
+// TimeSplit returns the split for a time bucket (month, week, or day) of
+// either the certificate NotBefore (notBefore) or the entry timestamp (logged)
+func TimeSplit(source, bucket string) (string, error) {
+	split := source + ":" + bucket
+	if _, err := parseSplit(split); err != nil {
+		return "", err
+	}
+	return split, nil
+}
+
+// parseSplit parses either a group (e.g. issuer) or a time bucket of a time
+// source (e.g. notBefore:month)
+func parseSplit(split string) (splitKey, error) {
+	fields := strings.SplitN(split, ":", 2)
+	if len(fields) == 1 {
+		group, present := groupKeys[split]
+		if !present {
+			return nil, fmt.Errorf("unknown group '%s', expected issuer, issuerOrg, keyType, sigAlg, or etld1", split)
+		}
+		return func(_ *ct.EntryAndPosition, cert *x509.Certificate) string {
+			if key := group(cert); key != "" {
+				return key
+			}
+			return "unknown"
+		}, nil
+	}
+	bucket, present := timeBuckets[fields[1]]
+	if !present {
+		return nil, fmt.Errorf("unknown time bucket '%s', expected month, week, or day", fields[1])
+	}
+	switch fields[0] {
+	case "notBefore":
+		return func(_ *ct.EntryAndPosition, cert *x509.Certificate) string {
+			return bucket(cert.NotBefore.UTC())
+		}, nil
+	case "logged":
+		return func(ent *ct.EntryAndPosition, _ *x509.Certificate) string {
+			if ent == nil {
+				return "unknown"
+			}
+			return bucket(time.Unix(0, int64(ent.Entry.Timestamp)*int64(time.Millisecond)).UTC())
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown time source '%s', expected notBefore or logged", fields[0])
+}
+
+type seriesPart struct {
+	Key   string
+	Datum jsonDatum
+}
+
+type seriesHolder struct {
+	Split string
+	Parts []seriesPart
+}
+
+// splitMetric keeps a separate generator for each key of a split, so a metric
+// split by notBefore:month has one generator per month and one grouped by
+// issuer has one per issuer
+type splitMetric struct {
+	split   string
+	key     splitKey
+	factory func() metricGenerator
+
+	mu    sync.Mutex
+	parts map[string]metricGenerator
+}
+
+func newSplitFactory(split string, key splitKey, factory func() metricGenerator) func() metricGenerator {
+	return func() metricGenerator {
+		return &splitMetric{split: split, key: key, factory: factory, parts: make(map[string]metricGenerator)}
+	}
+}
+
+// processEntry passes a certificate to a generator, split generators need the
+// entry it came from to find its key
+func processEntry(mg metricGenerator, ent *ct.EntryAndPosition, cert *x509.Certificate) {
+	if sm, ok := mg.(*splitMetric); ok {
+		sm.processEntry(ent, cert)
+		return
+	}
+	mg.process(cert)
+}
+
+func (sm *splitMetric) part(key string) metricGenerator {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	mg, present := sm.parts[key]
+	if !present {
+		mg = sm.factory()
+		sm.parts[key] = mg
+	}
+	return mg
+}
+
+// keys returns the keys seen so far, in order (time buckets sort
+// chronologically)
+func (sm *splitMetric) keys() []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	keys := []string{}
+	for k := range sm.parts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (sm *splitMetric) processEntry(ent *ct.EntryAndPosition, cert *x509.Certificate) {
+	processEntry(sm.part(sm.key(ent, cert)), ent, cert)
+}
+
+func (sm *splitMetric) process(cert *x509.Certificate) {
+	sm.processEntry(nil, cert)
+}
+
+func (sm *splitMetric) print(w io.Writer) {
+	for i, k := range sm.keys() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "## %s %s\n", sm.split, k)
+		sm.parts[k].print(w)
+	}
+}
+
+func (sm *splitMetric) json() jsonDatum {
+	holder := seriesHolder{Split: sm.split}
+	for _, k := range sm.keys() {
+		holder.Parts = append(holder.Parts, seriesPart{Key: k, Datum: sm.parts[k].json()})
+	}
+	return jsonDatum{Type: series, Data: holder}
+}
+
+func (sm *splitMetric) state() interface{} {
+	states := make(map[string]interface{})
+	for _, k := range sm.keys() {
+		states[k] = sm.parts[k].state()
+	}
+	return states
+}
+
+func (sm *splitMetric) merge(state json.RawMessage) error {
+	var states map[string]json.RawMessage
+	if err := json.Unmarshal(state, &states); err != nil {
+		return err
+	}
+	for k, s := range states {
+		if err := sm.part(k).merge(s); err != nil {
+			return fmt.Errorf("%s %s: %s", sm.split, k, err)
+		}
+	}
+	return nil
+}
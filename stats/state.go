@@ -0,0 +1,110 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/rolandshoemaker/ctat/common"
+)
+
+type savedMetric struct {
+	Name   string
+	Splits []string
+	State  json.RawMessage
+}
+
+// savedState is what --format state writes, the raw accumulated state of an
+// analysis rather than the results so analyses of different caches can be
+// merged
+type savedState struct {
+	Timestamp  time.Time
+	Metrics    []savedMetric
+	Drops      *common.Drops
+	CTErrors   strMap
+	X509Errors strMap
+}
+
+func (a *analysis) state() (*savedState, error) {
+	ss := &savedState{Timestamp: time.Now(), Drops: a.drops, CTErrors: a.ctErrors, X509Errors: a.x509Errors}
+	for _, m := range a.metrics {
+		state, err := json.Marshal(m.generator.state())
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal state for '%s': %s", m.name, err)
+		}
+		ss.Metrics = append(ss.Metrics, savedMetric{Name: m.name, Splits: m.splits, State: state})
+	}
+	return ss, nil
+}
+
+// merge adds a saved state to the analysis, metrics that haven't been seen
+// before (or were split differently) are added in the order they appear
+func (a *analysis) merge(ss *savedState) error {
+	if ss.Drops != nil {
+		a.drops.Merge(ss.Drops)
+	}
+	if ss.CTErrors != nil || ss.X509Errors != nil {
+		if a.ctErrors == nil {
+			a.ctErrors, a.x509Errors = make(strMap), make(strMap)
+		}
+		addStrMap(a.ctErrors, ss.CTErrors)
+		addStrMap(a.x509Errors, ss.X509Errors)
+	}
+	for _, sm := range ss.Metrics {
+		var generator metricGenerator
+		for _, m := range a.metrics {
+			if m.name == sm.Name && sameSplits(m.splits, sm.Splits) {
+				generator = m.generator
+				break
+			}
+		}
+		if generator == nil {
+			var err error
+			if generator, err = newGenerator(sm.Name, sm.Splits); err != nil {
+				return err
+			}
+			a.metrics = append(a.metrics, metric{name: sm.Name, splits: sm.Splits, generator: generator})
+		}
+		if err := generator.merge(sm.State); err != nil {
+			return fmt.Errorf("failed to merge state for '%s': %s", sm.Name, err)
+		}
+	}
+	return nil
+}
+
+func sameSplits(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MergeStates combines the states written by 'analyse --format state' and
+// writes the combined results
+func MergeStates(stateFiles []string, format string, output io.Writer) error {
+	if !ValidFormat(format) {
+		return fmt.Errorf("unknown output format '%s'", format)
+	}
+	a := &analysis{drops: common.NewDrops(nil)}
+	for _, filename := range stateFiles {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var ss savedState
+		if err = json.Unmarshal(data, &ss); err != nil {
+			return fmt.Errorf("failed to parse state file '%s': %s", filename, err)
+		}
+		if err = a.merge(&ss); err != nil {
+			return fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	return a.write(output, format)
+}
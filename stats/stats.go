@@ -1,13 +1,12 @@
 package stats
 
 import (
-	"crypto/dsa"
-	"crypto/ecdsa"
-	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"sort"
@@ -37,17 +36,17 @@ func (d intDistribution) Len() int           { return len(d) }
 func (d intDistribution) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
 func (d intDistribution) Less(i, j int) bool { return d[i].Value < d[j].Value }
 
-func (d intDistribution) print(valueLabel string, sum int) {
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
-	fmt.Fprintf(w, "Frequency\t\t%s\t \n", valueLabel)
-	fmt.Fprintf(w, "-----\t\t%s\t \n", strings.Repeat("-", len(valueLabel)))
+func (d intDistribution) print(w io.Writer, valueLabel string, sum int) {
+	tw := new(tabwriter.Writer)
+	tw.Init(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Frequency\t\t%s\t \n", valueLabel)
+	fmt.Fprintf(tw, "-----\t\t%s\t \n", strings.Repeat("-", len(valueLabel)))
 	maxWidth := 100.0
 	for _, b := range d {
 		percent := float64(b.Frequency) / float64(sum)
-		fmt.Fprintf(w, "%d\t%.4f%%\t%d\t%s\n", b.Frequency, percent*100.0, b.Value, strings.Repeat("*", int(maxWidth*percent)))
+		fmt.Fprintf(tw, "%d\t%.4f%%\t%d\t%s\n", b.Frequency, percent*100.0, b.Value, strings.Repeat("*", int(maxWidth*percent)))
 	}
-	w.Flush()
+	tw.Flush()
 }
 
 type strBucket struct {
@@ -61,17 +60,17 @@ func (d strDistribution) Len() int           { return len(d) }
 func (d strDistribution) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
 func (d strDistribution) Less(i, j int) bool { return d[i].Frequency > d[j].Frequency }
 
-func (d strDistribution) print(valueLabel string, sum int) {
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 8, 2, ' ', 0)
-	fmt.Fprintf(w, "Frequency\t\t%s\t \n", valueLabel)
-	fmt.Fprintf(w, "-----\t\t%s\t \n", strings.Repeat("-", len(valueLabel)))
+func (d strDistribution) print(w io.Writer, valueLabel string, sum int) {
+	tw := new(tabwriter.Writer)
+	tw.Init(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "Frequency\t\t%s\t \n", valueLabel)
+	fmt.Fprintf(tw, "-----\t\t%s\t \n", strings.Repeat("-", len(valueLabel)))
 	maxWidth := 100.0
 	for _, b := range d {
 		percent := float64(b.Frequency) / float64(sum)
-		fmt.Fprintf(w, "%d\t%.4f%%\t%s\t%s\n", b.Frequency, percent*100.0, b.Value, strings.Repeat("*", int(maxWidth*percent)))
+		fmt.Fprintf(tw, "%d\t%.4f%%\t%s\t%s\n", b.Frequency, percent*100.0, b.Value, strings.Repeat("*", int(maxWidth*percent)))
 	}
-	w.Flush()
+	tw.Flush()
 }
 
 type strMap map[string]int
@@ -106,6 +105,7 @@ func mapToIntDist(stuff intMap, cutoff int) (intDistribution, int) {
 }
 
 type distHolder struct {
+	Name  string
 	Dist  interface{}
 	Label string
 }
@@ -118,10 +118,12 @@ type statHolder struct {
 type datumType string
 
 var (
-	singleStat = datumType("single-stat")
-	multiStat  = datumType("multi-stat")
-	singleDist = datumType("single-dist")
-	multiDist  = datumType("multi-dist")
+	singleStat   = datumType("single-stat")
+	multiStat    = datumType("multi-stat")
+	singleDist   = datumType("single-dist")
+	multiDist    = datumType("multi-dist")
+	series       = datumType("series")
+	metricResult = datumType("result")
 )
 
 type jsonDatum struct {
@@ -133,49 +135,129 @@ type jsonDatum struct {
 type jsonHolder struct {
 	Timestamp time.Time
 	Stats     []jsonDatum
+	Drops     *common.Drops
 }
 
 type metricGenerator interface {
 	process(*x509.Certificate)
-	print()
-	// json() jsonDatum
+	print(io.Writer)
+	json() jsonDatum
+	// state returns everything the generator has accumulated in a form that
+	// can be marshalled to JSON, merge adds a state from another generator of
+	// the same type
+	state() interface{}
+	merge(json.RawMessage) error
+}
+
+// metric is a generator, the name it was selected by and the series it is
+// split into
+type metric struct {
+	name      string
+	splits    []string
+	generator metricGenerator
+}
+
+func addIntMap(dst, src intMap) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+func addStrMap(dst, src strMap) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+func mergeIntMap(dst intMap, state json.RawMessage) error {
+	var src intMap
+	if err := json.Unmarshal(state, &src); err != nil {
+		return err
+	}
+	addIntMap(dst, src)
+	return nil
+}
+
+func mergeStrMap(dst strMap, state json.RawMessage) error {
+	var src strMap
+	if err := json.Unmarshal(state, &src); err != nil {
+		return err
+	}
+	addStrMap(dst, src)
+	return nil
+}
+
+func intDistDatum(label string, stuff intMap, cutoff int) jsonDatum {
+	dist, _ := mapToIntDist(stuff, cutoff)
+	return jsonDatum{Type: singleDist, Data: distHolder{Dist: dist, Label: label}}
+}
+
+func strDistDatum(label string, stuff strMap, cutoff int) jsonDatum {
+	dist, _ := mapToStrDist(stuff, cutoff)
+	return jsonDatum{Type: singleDist, Data: distHolder{Dist: dist, Label: label}}
 }
 
 var dnsTimeout = time.Second * 5
 
-var metricsLookup = map[string]metricGenerator{
-	"validityDist":      &validityDistribution{periods: make(intMap)},
-	"certSizeDist":      &certSizeDistribution{sizes: make(intMap)},
-	"nameMetrics":       &nameMetrics{names: make(strMap), nameSets: make(strMap)},
-	"sanSizeDist":       &sanSizeDistribution{sizes: make(intMap)},
-	"pkTypeDist":        &pkAlgDistribution{algs: make(strMap)},
-	"sigTypeDist":       &sigAlgDistribution{algs: make(strMap)},
-	"popularSuffixes":   &popularSuffixes{suffixes: make(strMap)},
-	"leafIssuers":       &leafIssuanceDist{issuances: make(strMap)},
-	"serialLengthDist":  &serialLengthDistribution{lengths: make(intMap)},
-	"keyUsageDist":      &keyUsageDist{usage: make(strMap)},
-	"featureMetrics":    &featureMetrics{features: make(strMap)},
-	"numExtensionsDist": &numExtensionsDistribution{extensions: make(intMap)},
-	"keySizeDist":       &keySizeDistribution{rsaSizes: make(intMap), dsaSizes: make(intMap), ellipticSizes: make(intMap)},
-	"keyTypeDist":       &keyTypeDistribution{keyTypes: make(strMap)},
-	"maxPathLengthDist": &maxPathLenDistribution{lengths: make(intMap)},
-	"keyReuseMetrics":   &keyReuseMetrics{hashes: make(map[[20]byte]int)},
-	"badASNMetrics":     &badASNMetrics{negativeSerialIssuers: make(map[string]int)},
-	"torDNSTest": &torDNSTest{
-		client:         &dns.Client{DialTimeout: dnsTimeout, ReadTimeout: dnsTimeout, Net: "tcp"},
-		normalResolver: "127.0.0.1:53",
-		torResolver:    "172.17.0.72:9053",
+// metricsLookup creates the generator for each metric, including those added
+// with Register. A new one is created for every run (and for every group or
+// time bucket when a metric is split).
+var metricsLookup = map[string]func() metricGenerator{
+	"validityDist":      func() metricGenerator { return &validityDistribution{periods: make(intMap)} },
+	"certSizeDist":      func() metricGenerator { return &certSizeDistribution{sizes: make(intMap)} },
+	"nameMetrics":       func() metricGenerator { return &nameMetrics{names: make(strMap), nameSets: make(strMap)} },
+	"sanSizeDist":       func() metricGenerator { return &sanSizeDistribution{sizes: make(intMap)} },
+	"pkTypeDist":        func() metricGenerator { return &pkAlgDistribution{algs: make(strMap)} },
+	"sigTypeDist":       func() metricGenerator { return &sigAlgDistribution{algs: make(strMap)} },
+	"popularSuffixes":   func() metricGenerator { return &popularSuffixes{suffixes: make(strMap)} },
+	"leafIssuers":       func() metricGenerator { return &leafIssuanceDist{issuances: make(strMap)} },
+	"serialLengthDist":  func() metricGenerator { return &serialLengthDistribution{lengths: make(intMap)} },
+	"keyUsageDist":      func() metricGenerator { return &keyUsageDist{usage: make(strMap)} },
+	"featureMetrics":    func() metricGenerator { return &featureMetrics{features: make(strMap)} },
+	"numExtensionsDist": func() metricGenerator { return &numExtensionsDistribution{extensions: make(intMap)} },
+	"keySizeDist": func() metricGenerator {
+		return &keySizeDistribution{rsaSizes: make(intMap), dsaSizes: make(intMap), ellipticSizes: make(intMap)}
+	},
+	"keyTypeDist":       func() metricGenerator { return &keyTypeDistribution{keyTypes: make(strMap)} },
+	"maxPathLengthDist": func() metricGenerator { return &maxPathLenDistribution{lengths: make(intMap)} },
+	"keyReuseMetrics":   func() metricGenerator { return &keyReuseMetrics{hashes: make(map[[20]byte]int)} },
+	"badASNMetrics":     func() metricGenerator { return &badASNMetrics{negativeSerialIssuers: make(map[string]int)} },
+	"torDNSTest": func() metricGenerator {
+		return &torDNSTest{
+			client:         &dns.Client{DialTimeout: dnsTimeout, ReadTimeout: dnsTimeout, Net: "tcp"},
+			normalResolver: "127.0.0.1:53",
+			torResolver:    "172.17.0.72:9053",
+		}
 	},
 }
 
-func StringToMetrics(metricsString string) ([]metricGenerator, error) {
-	var metrics []metricGenerator
+// newGenerator creates the generator for a metric, split into a series by
+// each of splits, outermost first
+func newGenerator(name string, splits []string) (metricGenerator, error) {
+	factory, present := metricsLookup[name]
+	if !present {
+		return nil, fmt.Errorf("unknown metric '%s'", name)
+	}
+	for i := len(splits) - 1; i >= 0; i-- {
+		key, err := parseSplit(splits[i])
+		if err != nil {
+			return nil, err
+		}
+		factory = newSplitFactory(splits[i], key, factory)
+	}
+	return factory(), nil
+}
+
+// StringToMetrics creates the metrics in a comma separated list of names,
+// splits are the series (e.g. notBefore:month) each metric is split into
+func StringToMetrics(metricsString string, splits []string) ([]metric, error) {
+	var metrics []metric
 	for _, metricName := range strings.Split(metricsString, ",") {
-		if generator, present := metricsLookup[metricName]; present {
-			metrics = append(metrics, generator)
-		} else if !present {
-			return nil, fmt.Errorf("invalid metric name")
+		generator, err := newGenerator(metricName, splits)
+		if err != nil {
+			return nil, err
 		}
+		metrics = append(metrics, metric{name: metricName, splits: splits, generator: generator})
 	}
 	if len(metrics) == 0 {
 		return nil, fmt.Errorf("at least one metric is required to continue")
@@ -215,7 +297,6 @@ func StringToCutoffs(cutoffs string) error {
 type certSizeDistribution struct {
 	sizes intMap
 	mu    sync.Mutex
-	dist  intDistribution
 }
 
 func (csd *certSizeDistribution) process(cert *x509.Certificate) {
@@ -225,17 +306,22 @@ func (csd *certSizeDistribution) process(cert *x509.Certificate) {
 	csd.sizes[certSize]++
 }
 
-func (csd *certSizeDistribution) print() {
+func (csd *certSizeDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(csd.sizes, 0)
-	fmt.Println("# Certificate size distribution")
-	dist.print("Size (bytes)", sum)
-	jd := jsonDatum{Data: distHolder{Dist: dist, Label: "Size (bytes)"}}
-	d, e := json.Marshal(jd)
-	fmt.Println(string(d), e)
+	fmt.Fprintln(w, "# Certificate size distribution")
+	dist.print(w, "Size (bytes)", sum)
 }
 
 func (csd *certSizeDistribution) json() jsonDatum {
-	return jsonDatum{Name: "", Data: csd.dist}
+	return intDistDatum("Size (bytes)", csd.sizes, 0)
+}
+
+func (csd *certSizeDistribution) state() interface{} {
+	return csd.sizes
+}
+
+func (csd *certSizeDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(csd.sizes, state)
 }
 
 type validityDistribution struct {
@@ -251,10 +337,22 @@ func (vd *validityDistribution) process(cert *x509.Certificate) {
 	vd.periods[period]++
 }
 
-func (vd *validityDistribution) print() {
+func (vd *validityDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(vd.periods, 0)
-	fmt.Println("# Validity period distribution")
-	dist.print("Validity period (months)", sum)
+	fmt.Fprintln(w, "# Validity period distribution")
+	dist.print(w, "Validity period (months)", sum)
+}
+
+func (vd *validityDistribution) json() jsonDatum {
+	return intDistDatum("Validity period (months)", vd.periods, 0)
+}
+
+func (vd *validityDistribution) state() interface{} {
+	return vd.periods
+}
+
+func (vd *validityDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(vd.periods, state)
 }
 
 type sanSizeDistribution struct {
@@ -269,10 +367,22 @@ func (ssd *sanSizeDistribution) process(cert *x509.Certificate) {
 	ssd.sizes[size]++
 }
 
-func (ssd *sanSizeDistribution) print() {
+func (ssd *sanSizeDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(ssd.sizes, 0)
-	fmt.Println("# SAN num distribution")
-	dist.print("Number of SANs", sum)
+	fmt.Fprintln(w, "# SAN num distribution")
+	dist.print(w, "Number of SANs", sum)
+}
+
+func (ssd *sanSizeDistribution) json() jsonDatum {
+	return intDistDatum("Number of SANs", ssd.sizes, 0)
+}
+
+func (ssd *sanSizeDistribution) state() interface{} {
+	return ssd.sizes
+}
+
+func (ssd *sanSizeDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(ssd.sizes, state)
 }
 
 type serialLengthDistribution struct {
@@ -286,10 +396,22 @@ func (sld *serialLengthDistribution) process(cert *x509.Certificate) {
 	sld.lengths[cert.SerialNumber.BitLen()]++
 }
 
-func (sld *serialLengthDistribution) print() {
+func (sld *serialLengthDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(sld.lengths, 0)
-	fmt.Println("# Serial number length distribution")
-	dist.print("Serial bit length", sum)
+	fmt.Fprintln(w, "# Serial number length distribution")
+	dist.print(w, "Serial bit length", sum)
+}
+
+func (sld *serialLengthDistribution) json() jsonDatum {
+	return intDistDatum("Serial bit length", sld.lengths, 0)
+}
+
+func (sld *serialLengthDistribution) state() interface{} {
+	return sld.lengths
+}
+
+func (sld *serialLengthDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(sld.lengths, state)
 }
 
 type numExtensionsDistribution struct {
@@ -303,10 +425,22 @@ func (ned *numExtensionsDistribution) process(cert *x509.Certificate) {
 	ned.extensions[len(cert.Extensions)]++
 }
 
-func (ned *numExtensionsDistribution) print() {
+func (ned *numExtensionsDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(ned.extensions, 0)
-	fmt.Println("# TLS extension number distribution")
-	dist.print("Num TLS extensions", sum)
+	fmt.Fprintln(w, "# TLS extension number distribution")
+	dist.print(w, "Num TLS extensions", sum)
+}
+
+func (ned *numExtensionsDistribution) json() jsonDatum {
+	return intDistDatum("Num TLS extensions", ned.extensions, 0)
+}
+
+func (ned *numExtensionsDistribution) state() interface{} {
+	return ned.extensions
+}
+
+func (ned *numExtensionsDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(ned.extensions, state)
 }
 
 var pkAlgToString = map[x509.PublicKeyAlgorithm]string{
@@ -331,26 +465,22 @@ func (pad *pkAlgDistribution) process(cert *x509.Certificate) {
 	pad.algs[alg]++
 }
 
-func (pad *pkAlgDistribution) print() {
+func (pad *pkAlgDistribution) print(w io.Writer) {
 	dist, sum := mapToStrDist(pad.algs, 0)
-	fmt.Println("# Public key type distribution")
-	dist.print("Type", sum)
-}
-
-var sigAlgToString = map[x509.SignatureAlgorithm]string{
-	0:  "Unknown",
-	1:  "MD2 With RSA",
-	2:  "MD5 With RSA",
-	3:  "SHA1 With RSA",
-	4:  "SHA256 With RSA",
-	5:  "SHA384 With RSA",
-	6:  "SHA512 With RSA",
-	7:  "DSA With SHA1",
-	8:  "DSA With SHA256",
-	9:  "ECDSA With SHA1",
-	10: "ECDSA With SHA256",
-	11: "ECDSA With SHA384",
-	12: "ECDSA With SHA512",
+	fmt.Fprintln(w, "# Public key type distribution")
+	dist.print(w, "Type", sum)
+}
+
+func (pad *pkAlgDistribution) json() jsonDatum {
+	return strDistDatum("Type", pad.algs, 0)
+}
+
+func (pad *pkAlgDistribution) state() interface{} {
+	return pad.algs
+}
+
+func (pad *pkAlgDistribution) merge(state json.RawMessage) error {
+	return mergeStrMap(pad.algs, state)
 }
 
 type sigAlgDistribution struct {
@@ -359,7 +489,7 @@ type sigAlgDistribution struct {
 }
 
 func (sad *sigAlgDistribution) process(cert *x509.Certificate) {
-	alg, ok := sigAlgToString[cert.SignatureAlgorithm]
+	alg, ok := filter.SigAlgToString[cert.SignatureAlgorithm]
 	if !ok {
 		return
 	}
@@ -368,10 +498,22 @@ func (sad *sigAlgDistribution) process(cert *x509.Certificate) {
 	sad.algs[alg]++
 }
 
-func (sad *sigAlgDistribution) print() {
+func (sad *sigAlgDistribution) print(w io.Writer) {
 	dist, sum := mapToStrDist(sad.algs, 0)
-	fmt.Println("# Signature type distribution")
-	dist.print("Type", sum)
+	fmt.Fprintln(w, "# Signature type distribution")
+	dist.print(w, "Type", sum)
+}
+
+func (sad *sigAlgDistribution) json() jsonDatum {
+	return strDistDatum("Type", sad.algs, 0)
+}
+
+func (sad *sigAlgDistribution) state() interface{} {
+	return sad.algs
+}
+
+func (sad *sigAlgDistribution) merge(state json.RawMessage) error {
+	return mergeStrMap(sad.algs, state)
 }
 
 type popularSuffixes struct {
@@ -393,10 +535,22 @@ func (ps *popularSuffixes) process(cert *x509.Certificate) {
 
 var popularSuffixesCutoff = 500
 
-func (ps *popularSuffixes) print() {
+func (ps *popularSuffixes) print(w io.Writer) {
 	dist, sum := mapToStrDist(ps.suffixes, popularSuffixesCutoff)
-	fmt.Println("# Popular DNS name suffixes")
-	dist.print("eTLD+1", sum)
+	fmt.Fprintln(w, "# Popular DNS name suffixes")
+	dist.print(w, "eTLD+1", sum)
+}
+
+func (ps *popularSuffixes) json() jsonDatum {
+	return strDistDatum("eTLD+1", ps.suffixes, popularSuffixesCutoff)
+}
+
+func (ps *popularSuffixes) state() interface{} {
+	return ps.suffixes
+}
+
+func (ps *popularSuffixes) merge(state json.RawMessage) error {
+	return mergeStrMap(ps.suffixes, state)
 }
 
 type leafIssuanceDist struct {
@@ -412,10 +566,22 @@ func (lid *leafIssuanceDist) process(cert *x509.Certificate) {
 
 var leafIssuanceCutoff = 500
 
-func (lid *leafIssuanceDist) print() {
+func (lid *leafIssuanceDist) print(w io.Writer) {
 	dist, sum := mapToStrDist(lid.issuances, leafIssuanceCutoff)
-	fmt.Println("# Leaf issuers")
-	dist.print("Issuer distinguished name", sum)
+	fmt.Fprintln(w, "# Leaf issuers")
+	dist.print(w, "Issuer distinguished name", sum)
+}
+
+func (lid *leafIssuanceDist) json() jsonDatum {
+	return strDistDatum("Issuer distinguished name", lid.issuances, leafIssuanceCutoff)
+}
+
+func (lid *leafIssuanceDist) state() interface{} {
+	return lid.issuances
+}
+
+func (lid *leafIssuanceDist) merge(state json.RawMessage) error {
+	return mergeStrMap(lid.issuances, state)
 }
 
 var keyUsageLookup = map[x509.ExtKeyUsage]string{
@@ -451,10 +617,22 @@ func (kud *keyUsageDist) process(cert *x509.Certificate) {
 	kud.usage[strings.Join(usages, ", ")]++
 }
 
-func (kud *keyUsageDist) print() {
+func (kud *keyUsageDist) print(w io.Writer) {
 	dist, sum := mapToStrDist(kud.usage, 0)
-	fmt.Println("# Key usage distribution")
-	dist.print("Usage sets", sum)
+	fmt.Fprintln(w, "# Key usage distribution")
+	dist.print(w, "Usage sets", sum)
+}
+
+func (kud *keyUsageDist) json() jsonDatum {
+	return strDistDatum("Usage sets", kud.usage, 0)
+}
+
+func (kud *keyUsageDist) state() interface{} {
+	return kud.usage
+}
+
+func (kud *keyUsageDist) merge(state json.RawMessage) error {
+	return mergeStrMap(kud.usage, state)
 }
 
 type keyTypeDistribution struct {
@@ -463,22 +641,31 @@ type keyTypeDistribution struct {
 }
 
 func (ktd *keyTypeDistribution) process(cert *x509.Certificate) {
+	keyType := filter.KeyType(cert)
+	if keyType == "" {
+		return
+	}
 	ktd.mu.Lock()
 	defer ktd.mu.Unlock()
-	switch cert.PublicKey.(type) {
-	case *rsa.PublicKey:
-		ktd.keyTypes["RSA"]++
-	case *dsa.PublicKey:
-		ktd.keyTypes["DSA"]++
-	case *ecdsa.PublicKey:
-		ktd.keyTypes["ECDSA"]++
-	}
+	ktd.keyTypes[keyType]++
 }
 
-func (ktd *keyTypeDistribution) print() {
+func (ktd *keyTypeDistribution) print(w io.Writer) {
 	dist, sum := mapToStrDist(ktd.keyTypes, 0)
-	fmt.Println("# Key type distribution")
-	dist.print("Type", sum)
+	fmt.Fprintln(w, "# Key type distribution")
+	dist.print(w, "Type", sum)
+}
+
+func (ktd *keyTypeDistribution) json() jsonDatum {
+	return strDistDatum("Type", ktd.keyTypes, 0)
+}
+
+func (ktd *keyTypeDistribution) state() interface{} {
+	return ktd.keyTypes
+}
+
+func (ktd *keyTypeDistribution) merge(state json.RawMessage) error {
+	return mergeStrMap(ktd.keyTypes, state)
 }
 
 type nameMetrics struct {
@@ -506,16 +693,49 @@ func (nm *nameMetrics) process(cert *x509.Certificate) {
 	}
 }
 
-func (nm *nameMetrics) print() {
-	fmt.Printf("# DNS name metrics\n\n")
-	fmt.Printf("%d names across %d certificates\n", nm.totalNames, nm.totalNameSets)
-	fmt.Printf(
+func (nm *nameMetrics) print(w io.Writer) {
+	fmt.Fprintf(w, "# DNS name metrics\n\n")
+	fmt.Fprintf(w, "%d names across %d certificates\n", nm.totalNames, nm.totalNameSets)
+	fmt.Fprintf(
+		w,
 		"%.2f%% of names existed in multiple certificates\n%.2f%% of certificates had duplicate name sets\n",
 		(1.0-(float64(len(nm.names))/float64(nm.totalNames)))*100.0,
 		(1.0-(float64(len(nm.nameSets))/float64(nm.totalNameSets)))*100.0,
 	)
 }
 
+func (nm *nameMetrics) json() jsonDatum {
+	return jsonDatum{Type: multiStat, Data: []statHolder{
+		{Value: int(nm.totalNames), Label: "Names"},
+		{Value: len(nm.names), Label: "Unique names"},
+		{Value: int(nm.totalNameSets), Label: "Certificates"},
+		{Value: len(nm.nameSets), Label: "Unique name sets"},
+	}}
+}
+
+type nameMetricsState struct {
+	Names         strMap
+	TotalNames    int64
+	NameSets      strMap
+	TotalNameSets int64
+}
+
+func (nm *nameMetrics) state() interface{} {
+	return nameMetricsState{Names: nm.names, TotalNames: nm.totalNames, NameSets: nm.nameSets, TotalNameSets: nm.totalNameSets}
+}
+
+func (nm *nameMetrics) merge(state json.RawMessage) error {
+	var other nameMetricsState
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	addStrMap(nm.names, other.Names)
+	addStrMap(nm.nameSets, other.NameSets)
+	nm.totalNames += other.TotalNames
+	nm.totalNameSets += other.TotalNameSets
+	return nil
+}
+
 var featureLookup = map[string]string{
 	"1.3.6.1.4.1.11129.2.4.2": "Embedded SCT",
 	"1.3.6.1.5.5.7.1.24":      "OCSP must staple",
@@ -536,10 +756,22 @@ func (fm *featureMetrics) process(cert *x509.Certificate) {
 	}
 }
 
-func (fm *featureMetrics) print() {
+func (fm *featureMetrics) print(w io.Writer) {
 	dist, sum := mapToStrDist(fm.features, 0)
-	fmt.Println("# TLS feature extension usage")
-	dist.print("Extension name", sum)
+	fmt.Fprintln(w, "# TLS feature extension usage")
+	dist.print(w, "Extension name", sum)
+}
+
+func (fm *featureMetrics) json() jsonDatum {
+	return strDistDatum("Extension name", fm.features, 0)
+}
+
+func (fm *featureMetrics) state() interface{} {
+	return fm.features
+}
+
+func (fm *featureMetrics) merge(state json.RawMessage) error {
+	return mergeStrMap(fm.features, state)
 }
 
 type keySizeDistribution struct {
@@ -552,32 +784,65 @@ type keySizeDistribution struct {
 }
 
 func (ksd *keySizeDistribution) process(cert *x509.Certificate) {
-	switch k := cert.PublicKey.(type) {
-	case *rsa.PublicKey:
+	size := filter.KeySize(cert)
+	switch filter.KeyType(cert) {
+	case "RSA":
 		ksd.rMu.Lock()
 		defer ksd.rMu.Unlock()
-		ksd.rsaSizes[k.N.BitLen()]++
-	case *dsa.PublicKey:
+		ksd.rsaSizes[size]++
+	case "DSA":
 		ksd.dMu.Lock()
 		defer ksd.dMu.Unlock()
-		ksd.dsaSizes[k.Y.BitLen()]++
-	case *ecdsa.PublicKey:
+		ksd.dsaSizes[size]++
+	case "ECDSA":
 		ksd.eMu.Lock()
 		defer ksd.eMu.Unlock()
-		ksd.ellipticSizes[k.Params().BitSize]++
+		ksd.ellipticSizes[size]++
 	}
 }
 
-func (ksd *keySizeDistribution) print() {
+func (ksd *keySizeDistribution) print(w io.Writer) {
 	dsaDist, dsaSum := mapToIntDist(ksd.dsaSizes, 0)
 	rsaDist, rsaSum := mapToIntDist(ksd.rsaSizes, 0)
 	ecDist, ecSum := mapToIntDist(ksd.ellipticSizes, 0)
-	fmt.Println("# DSA key size distribution")
-	dsaDist.print("Bit length", dsaSum)
-	fmt.Println("# RSA key size distribution")
-	rsaDist.print("Bit length", rsaSum)
-	fmt.Println("# ECDSA key size distribution")
-	ecDist.print("Bit length", ecSum)
+	fmt.Fprintln(w, "# DSA key size distribution")
+	dsaDist.print(w, "Bit length", dsaSum)
+	fmt.Fprintln(w, "# RSA key size distribution")
+	rsaDist.print(w, "Bit length", rsaSum)
+	fmt.Fprintln(w, "# ECDSA key size distribution")
+	ecDist.print(w, "Bit length", ecSum)
+}
+
+func (ksd *keySizeDistribution) json() jsonDatum {
+	dsaDist, _ := mapToIntDist(ksd.dsaSizes, 0)
+	rsaDist, _ := mapToIntDist(ksd.rsaSizes, 0)
+	ecDist, _ := mapToIntDist(ksd.ellipticSizes, 0)
+	return jsonDatum{Type: multiDist, Data: []distHolder{
+		{Name: "DSA", Dist: dsaDist, Label: "Bit length"},
+		{Name: "RSA", Dist: rsaDist, Label: "Bit length"},
+		{Name: "ECDSA", Dist: ecDist, Label: "Bit length"},
+	}}
+}
+
+type keySizeState struct {
+	RSA   intMap
+	DSA   intMap
+	ECDSA intMap
+}
+
+func (ksd *keySizeDistribution) state() interface{} {
+	return keySizeState{RSA: ksd.rsaSizes, DSA: ksd.dsaSizes, ECDSA: ksd.ellipticSizes}
+}
+
+func (ksd *keySizeDistribution) merge(state json.RawMessage) error {
+	var other keySizeState
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	addIntMap(ksd.rsaSizes, other.RSA)
+	addIntMap(ksd.dsaSizes, other.DSA)
+	addIntMap(ksd.ellipticSizes, other.ECDSA)
+	return nil
 }
 
 type maxPathLenDistribution struct {
@@ -593,10 +858,22 @@ func (mpld *maxPathLenDistribution) process(cert *x509.Certificate) {
 	}
 }
 
-func (mpld *maxPathLenDistribution) print() {
+func (mpld *maxPathLenDistribution) print(w io.Writer) {
 	dist, sum := mapToIntDist(mpld.lengths, 0)
-	fmt.Println("# Max path length distribution")
-	dist.print("Path length", sum)
+	fmt.Fprintln(w, "# Max path length distribution")
+	dist.print(w, "Path length", sum)
+}
+
+func (mpld *maxPathLenDistribution) json() jsonDatum {
+	return intDistDatum("Path length", mpld.lengths, 0)
+}
+
+func (mpld *maxPathLenDistribution) state() interface{} {
+	return mpld.lengths
+}
+
+func (mpld *maxPathLenDistribution) merge(state json.RawMessage) error {
+	return mergeIntMap(mpld.lengths, state)
 }
 
 var keyReuseCutoff = 100
@@ -613,7 +890,7 @@ func (krm *keyReuseMetrics) process(cert *x509.Certificate) {
 	krm.hashes[hash]++
 }
 
-func (krm *keyReuseMetrics) print() {
+func (krm *keyReuseMetrics) print(w io.Writer) {
 	reuseDistMap := make(map[int]int)
 	hashMap := make(map[string]int)
 	for k, v := range krm.hashes {
@@ -624,12 +901,55 @@ func (krm *keyReuseMetrics) print() {
 	}
 
 	reuseDist, reuseSum := mapToIntDist(reuseDistMap, 1)
-	fmt.Println("# Reused key frequency distribution")
-	reuseDist.print("Frequency", reuseSum)
+	fmt.Fprintln(w, "# Reused key frequency distribution")
+	reuseDist.print(w, "Frequency", reuseSum)
 
 	hashDist, hashSum := mapToStrDist(hashMap, keyReuseCutoff)
-	fmt.Printf("# Keys reused more than %d times\n", keyReuseCutoff)
-	hashDist.print("Public key SHA1 hash", hashSum)
+	fmt.Fprintf(w, "# Keys reused more than %d times\n", keyReuseCutoff)
+	hashDist.print(w, "Public key SHA1 hash", hashSum)
+}
+
+func (krm *keyReuseMetrics) json() jsonDatum {
+	reuseDistMap := make(intMap)
+	hashMap := make(strMap)
+	for k, v := range krm.hashes {
+		reuseDistMap[v]++
+		if v > keyReuseCutoff {
+			hashMap[fmt.Sprintf("%X", k)] = v
+		}
+	}
+	reuseDist, _ := mapToIntDist(reuseDistMap, 1)
+	hashDist, _ := mapToStrDist(hashMap, keyReuseCutoff)
+	return jsonDatum{Type: multiDist, Data: []distHolder{
+		{Name: "Reused key frequency", Dist: reuseDist, Label: "Frequency"},
+		{Name: fmt.Sprintf("Keys reused more than %d times", keyReuseCutoff), Dist: hashDist, Label: "Public key SHA1 hash"},
+	}}
+}
+
+// state keys hashes by their hex encoding, JSON objects can't have array keys
+func (krm *keyReuseMetrics) state() interface{} {
+	hashes := make(strMap, len(krm.hashes))
+	for k, v := range krm.hashes {
+		hashes[hex.EncodeToString(k[:])] = v
+	}
+	return hashes
+}
+
+func (krm *keyReuseMetrics) merge(state json.RawMessage) error {
+	var other strMap
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	for k, v := range other {
+		decoded, err := hex.DecodeString(k)
+		if err != nil || len(decoded) != sha1.Size {
+			return fmt.Errorf("invalid key hash '%s'", k)
+		}
+		var hash [20]byte
+		copy(hash[:], decoded)
+		krm.hashes[hash] += v
+	}
+	return nil
 }
 
 type badASNMetrics struct {
@@ -647,10 +967,22 @@ func (bam *badASNMetrics) process(cert *x509.Certificate) {
 	bam.negativeSerialIssuers[issuer]++
 }
 
-func (bam *badASNMetrics) print() {
+func (bam *badASNMetrics) print(w io.Writer) {
 	dist, sum := mapToStrDist(bam.negativeSerialIssuers, 0)
-	fmt.Println("# Issuers creating certificates with negative serial numbers")
-	dist.print("Issuer DN", sum)
+	fmt.Fprintln(w, "# Issuers creating certificates with negative serial numbers")
+	dist.print(w, "Issuer DN", sum)
+}
+
+func (bam *badASNMetrics) json() jsonDatum {
+	return strDistDatum("Issuer DN", bam.negativeSerialIssuers, 0)
+}
+
+func (bam *badASNMetrics) state() interface{} {
+	return strMap(bam.negativeSerialIssuers)
+}
+
+func (bam *badASNMetrics) merge(state json.RawMessage) error {
+	return mergeStrMap(strMap(bam.negativeSerialIssuers), state)
 }
 
 type torDNSTest struct {
@@ -696,9 +1028,10 @@ func (tdt *torDNSTest) process(cert *x509.Certificate) {
 	}
 }
 
-func (tdt *torDNSTest) print() {
-	fmt.Println("# Tor DNS lookup test")
-	fmt.Printf(
+func (tdt *torDNSTest) print(w io.Writer) {
+	fmt.Fprintln(w, "# Tor DNS lookup test")
+	fmt.Fprintf(
+		w,
 		"%d names checked, %.2f%% failed both tests, %.2f%% failed over Tor, %.2f%% failed with normal resolver",
 		tdt.totalChecked,
 		(float64(tdt.bothFailures)/float64(tdt.totalChecked))*100.0,
@@ -707,25 +1040,61 @@ func (tdt *torDNSTest) print() {
 	)
 }
 
-func Analyse(cacheFile string, filters []filter.Filter, generators []metricGenerator, measureErrors bool, mapWorkers int, progress bool) error {
+func (tdt *torDNSTest) json() jsonDatum {
+	return jsonDatum{Type: multiStat, Data: []statHolder{
+		{Value: int(tdt.totalChecked), Label: "Names checked"},
+		{Value: int(tdt.bothFailures), Label: "Failed both tests"},
+		{Value: int(tdt.torFailures), Label: "Failed over Tor"},
+		{Value: int(tdt.normalFailures), Label: "Failed with normal resolver"},
+	}}
+}
+
+type torDNSState struct {
+	TorFailures    int64
+	NormalFailures int64
+	BothFailures   int64
+	TotalChecked   int64
+}
+
+func (tdt *torDNSTest) state() interface{} {
+	return torDNSState{TorFailures: tdt.torFailures, NormalFailures: tdt.normalFailures, BothFailures: tdt.bothFailures, TotalChecked: tdt.totalChecked}
+}
+
+func (tdt *torDNSTest) merge(state json.RawMessage) error {
+	var other torDNSState
+	if err := json.Unmarshal(state, &other); err != nil {
+		return err
+	}
+	tdt.torFailures += other.TorFailures
+	tdt.normalFailures += other.NormalFailures
+	tdt.bothFailures += other.BothFailures
+	tdt.totalChecked += other.TotalChecked
+	return nil
+}
+
+func Analyse(cacheFile string, filters []filter.EntryFilter, filterNames []string, metrics []metric, measureErrors bool, mapWorkers int, progress, includePrecerts bool, format string, output io.Writer) error {
+	if !ValidFormat(format) {
+		return fmt.Errorf("unknown output format '%s'", format)
+	}
 	entries, err := common.LoadCacheFile(cacheFile)
 	if err != nil {
 		return err
 	}
+	defer entries.Close()
 	entries.MapWorkers = mapWorkers
 	stopProg := make(chan struct{}, 1)
 	totalCount := uint64(0)
 	processed := int64(0)
-	skipped := int64(0)
+	drops := common.NewDrops(filterNames)
 	started := time.Now()
 	if progress {
-		totalCount, err = entries.Count()
-		if err != nil {
-			return err
-		}
-		_, err = entries.File.Seek(0, 0)
-		if err != nil {
-			return err
+		// counting a compressed cache would mean decompressing it twice, so
+		// just show how many entries have been processed
+		if !entries.Compressed() {
+			totalCount, err = common.CountEntries(entries.EntriesFile, cacheFile)
+			if err != nil {
+				return err
+			}
 		}
 		go func() {
 			for {
@@ -735,16 +1104,22 @@ func Analyse(cacheFile string, filters []filter.Filter, generators []metricGener
 				default:
 					proc := atomic.LoadInt64(&processed)
 					lps := float64(processed) / time.Since(started).Seconds()
-					fmt.Printf("\x1b[80D\x1b[2K")
-					fmt.Printf(
-						"%d/%d (%.2f%%, %.2f%% skipped, %.2f/s), eta: %s",
-						proc,
-						totalCount,
-						(float64(proc)/float64(totalCount))*100.0,
-						(float64(atomic.LoadInt64(&skipped))/float64(totalCount))*100.0,
-						lps,
-						time.Duration(float64(int64(totalCount)-processed)/lps)*time.Second,
-					)
+					// progress goes to stderr so it doesn't end up mixed into results
+					fmt.Fprintf(os.Stderr, "\x1b[80D\x1b[2K")
+					if totalCount == 0 {
+						fmt.Fprintf(os.Stderr, "%d (%.2f/s)", proc, lps)
+					} else {
+						fmt.Fprintf(
+							os.Stderr,
+							"%d/%d (%.2f%%, %.2f%% skipped, %.2f/s), eta: %s",
+							proc,
+							totalCount,
+							(float64(proc)/float64(totalCount))*100.0,
+							(float64(atomic.LoadInt64(&drops.Entries)-atomic.LoadInt64(&drops.Kept))/float64(totalCount))*100.0,
+							lps,
+							time.Duration(float64(int64(totalCount)-processed)/lps)*time.Second,
+						)
+					}
 					time.Sleep(time.Millisecond * 250)
 				}
 			}
@@ -752,10 +1127,10 @@ func Analyse(cacheFile string, filters []filter.Filter, generators []metricGener
 	}
 
 	cMu := new(sync.Mutex)
-	ctErrors := make(map[string]int)
+	ctErrors := make(strMap)
 	xMu := new(sync.Mutex)
-	x509Errors := make(map[string]int)
-	entries.Map(func(ent *ct.EntryAndPosition, err error) {
+	x509Errors := make(strMap)
+	err = entries.Map(func(ent *ct.EntryAndPosition, err error) {
 		if progress {
 			defer atomic.AddInt64(&processed, 1)
 		}
@@ -765,52 +1140,43 @@ func Analyse(cacheFile string, filters []filter.Filter, generators []metricGener
 				ctErrors[err.Error()]++
 				cMu.Unlock()
 			}
-			atomic.AddInt64(&skipped, 1)
+			drops.EntryError()
 			return
 		}
 		// execute CT entry metric stuff (TODO!)
-		cert, skip, err := common.ParseAndFilter(ent.Entry.X509Cert, filters)
+		cert, skip, err := common.ParseEntryAndFilter(ent, filters, includePrecerts, drops)
 		if !skip && err != nil {
 			if measureErrors {
 				xMu.Lock()
 				x509Errors[err.Error()]++
 				xMu.Unlock()
 			}
-			atomic.AddInt64(&skipped, 1)
 			return
 		} else if skip {
-			atomic.AddInt64(&skipped, 1)
 			return
 		}
 		// execute leaf metric generators
 		wg := new(sync.WaitGroup)
-		for _, g := range generators {
+		for _, m := range metrics {
 			wg.Add(1)
 			go func(mg metricGenerator) {
-				mg.process(cert)
+				processEntry(mg, ent, cert)
 				wg.Done()
-			}(g)
+			}(m.generator)
 		}
 		wg.Wait()
 	})
 	if progress {
 		stopProg <- struct{}{}
-		fmt.Println("")
+		fmt.Fprintln(os.Stderr)
 	}
-
-	for _, g := range generators {
-		g.print()
-		fmt.Println("")
+	if err != nil {
+		return err
 	}
 
+	a := &analysis{metrics: metrics, drops: drops}
 	if measureErrors {
-		ctErrorDist, ctSum := mapToStrDist(ctErrors, 0)
-		x509ErrorsDist, x509Sum := mapToStrDist(x509Errors, 0)
-		fmt.Printf("\n# CT parsing errors\n")
-		ctErrorDist.print("Error", ctSum)
-		fmt.Println("# x509 parsing errors")
-		x509ErrorsDist.print("Error", x509Sum)
+		a.ctErrors, a.x509Errors = ctErrors, x509Errors
 	}
-
-	return nil
+	return a.write(output, format)
 }